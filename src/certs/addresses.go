@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// addressError is the failure of one of the addresses of a target.
+type addressError struct {
+	IP  string
+	Err error
+}
+
+func (e *addressError) Error() string { return e.IP + ": " + e.Err.Error() }
+
+func (e *addressError) Unwrap() error { return e.Err }
+
+// addressErrors are the addresses of a target that failed, in the order
+// they were resolved.
+type addressErrors []*addressError
+
+func (errs addressErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs addressErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
+
+// failedAddresses splits the error of a check into the addresses that
+// failed. Errors not tied to an address, such as a failed lookup, are
+// returned as a single failure without an IP.
+func failedAddresses(err error) addressErrors {
+	var errs addressErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	return addressErrors{{Err: err}}
+}
+
+// getAddressCertInfos checks every address target.Host resolves to,
+// sending the hostname as SNI. It returns the certificates of the
+// addresses that answered along with addressErrors for those that did
+// not, so one unreachable node neither hides behind the others nor hides
+// them.
+func getAddressCertInfos(target Target) ([]*CertInfo, error) {
+	ips, err := resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*CertInfo, len(ips))
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			t := target
+			t.IP = ip
+			results[i], errs[i] = getCertInfo(t)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	// Results of one round share a check time, so the latest round can
+	// be told apart from addresses that are no longer resolved.
+	now := time.Now()
+	var infos []*CertInfo
+	var failed addressErrors
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, &addressError{IP: ips[i], Err: err})
+			continue
+		}
+		results[i].CheckedAt = now
+		infos = append(infos, results[i])
+	}
+	if failed != nil {
+		return infos, failed
+	}
+	return infos, nil
+}
+
+// resolveTarget returns the IPv4 and IPv6 addresses of target.Host.
+func resolveTarget(target Target) ([]string, error) {
+	if ip := net.ParseIP(target.Host); ip != nil {
+		return []string{ip.String()}, nil
+	}
+
+	ctx := context.Background()
+	if target.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(target.DialTimeout))
+		defer cancel()
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips, nil
+}
+
+// consistentCerts reports, for every URL checked per address, whether all
+// its addresses serve the same certificate.
+func consistentCerts(certs []CertInfo) map[string]bool {
+	fingerprints := make(map[string]string)
+	consistent := make(map[string]bool)
+	for _, info := range certs {
+		if info.IP == "" {
+			continue
+		}
+		first, ok := fingerprints[info.URL]
+		if !ok {
+			fingerprints[info.URL] = info.FingerprintSHA256
+			consistent[info.URL] = true
+			continue
+		}
+		if first != info.FingerprintSHA256 {
+			consistent[info.URL] = false
+		}
+	}
+	return consistent
+}
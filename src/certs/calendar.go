@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const icsTimeFormat = "20060102T150405Z"
+
+var defaultCalendarAlarmDays = []int{30, 7, 1}
+
+// handleCalendar serves an iCalendar feed with an event at the expiry of
+// every tracked certificate, optionally limited to ?target and ?issuer.
+// Other query parameters filter by label, as in /certs/simple.
+//
+// Each certificate keeps its UID across renewals and the SEQUENCE counts
+// its rotations, so calendar clients move the event instead of adding a
+// new one.
+func handleCalendar(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	target := query.Get("target")
+	issuer := query.Get("issuer")
+	query.Del("target")
+	query.Del("issuer")
+
+	certs, err := latestCerts("valid_until ASC")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rotations, err := rotationCounts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cfg := currentConfig()
+	now := time.Now().UTC()
+
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//grafana-utils//certs//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "X-WR-CALNAME:Certificate expirations")
+
+	for _, info := range certs {
+		if target != "" && info.URL != target {
+			continue
+		}
+		if issuer != "" && info.IssuedBy != issuer {
+			continue
+		}
+		if !matchLabels(info.Labels, query) {
+			continue
+		}
+
+		subject := certSubject(&info)
+		rot := rotations[slotKey(info)]
+
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, "UID:"+calendarUID(info))
+		writeICSLine(&b, "DTSTAMP:"+now.Format(icsTimeFormat))
+		if !rot.last.IsZero() {
+			writeICSLine(&b, "LAST-MODIFIED:"+rot.last.UTC().Format(icsTimeFormat))
+		}
+		writeICSLine(&b, "SEQUENCE:"+strconv.Itoa(rot.count))
+		writeICSLine(&b, "DTSTART:"+info.ValidUntil.UTC().Format(icsTimeFormat))
+		writeICSLine(&b, "SUMMARY:"+escapeICS("Certificate expires: "+subject))
+		writeICSLine(&b, "DESCRIPTION:"+escapeICS(calendarDescription(info)))
+		writeICSLine(&b, "CATEGORIES:certificate")
+
+		for _, days := range cfg.CalendarAlarmDays {
+			writeICSLine(&b, "BEGIN:VALARM")
+			writeICSLine(&b, "ACTION:DISPLAY")
+			writeICSLine(&b, fmt.Sprintf("TRIGGER:-P%dD", days))
+			writeICSLine(&b, "DESCRIPTION:"+escapeICS(fmt.Sprintf("Certificate for %s expires in %d days", subject, days)))
+			writeICSLine(&b, "END:VALARM")
+		}
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+func calendarDescription(info CertInfo) string {
+	lines := []string{
+		"Target: " + info.URL,
+		"Issued to: " + info.IssuedTo,
+		"Issuer: " + info.IssuedBy,
+	}
+	if info.IP != "" {
+		lines = append(lines, "Address: "+info.IP)
+	}
+	if info.SourcePath != "" {
+		lines = append(lines, fmt.Sprintf("Source: %s #%d", info.SourcePath, info.SourceIndex))
+	}
+	if info.Namespace != "" {
+		line := fmt.Sprintf("Kubernetes: %s %s/%s", info.Kind, info.Namespace, info.Name)
+		if info.SecretKey != "" {
+			line += fmt.Sprintf(" %s #%d", info.SecretKey, info.SourceIndex)
+		}
+		lines = append(lines, line)
+	}
+	if sans := append(append([]string{}, info.DNSNames...), info.IPAddresses...); len(sans) > 0 {
+		lines = append(lines, "SANs: "+strings.Join(sans, ", "))
+	}
+	if info.SerialNumber != "" {
+		lines = append(lines, "Serial: "+info.SerialNumber)
+	}
+	lines = append(lines, "Valid until: "+info.ValidUntil.UTC().Format(time.RFC3339))
+	return strings.Join(lines, "\n")
+}
+
+// calendarUID identifies a certificate slot, which keeps its UID when the
+// certificate in it is renewed.
+func calendarUID(info CertInfo) string {
+	sum := sha256.Sum256([]byte(slotKey(info)))
+	return hex.EncodeToString(sum[:16]) + "@certs"
+}
+
+type rotationCount struct {
+	count int
+	last  time.Time
+}
+
+// slotKey identifies the slot a certificate was checked in across checks.
+// Kubernetes certificates are told apart by the object and key they were
+// read from, their SourceIndex being the position within that key.
+func slotKey(info CertInfo) string {
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%s", info.URL, info.SourcePath, info.SourceIndex, info.IP)
+	if info.Kind != "" {
+		key += fmt.Sprintf("\x00%s\x00%s\x00%s\x00%s", info.Namespace, info.Name, info.Kind, info.SecretKey)
+	}
+	return key
+}
+
+// rotationCounts returns how often each certificate was rotated, and when
+// it last was.
+func rotationCounts() (map[string]rotationCount, error) {
+	rows, err := db.Query(`
+    SELECT url, COALESCE(source_path, ''), COALESCE(source_index, 0), COALESCE(ip, ''),
+        COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, ''),
+        COUNT(*), MAX(rotated_at)
+    FROM cert_rotations
+    GROUP BY url, COALESCE(source_path, ''), COALESCE(source_index, 0), COALESCE(ip, ''),
+        COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, '')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]rotationCount)
+	for rows.Next() {
+		var rot Rotation
+		var lastStr string
+		var c rotationCount
+		err := rows.Scan(&rot.URL, &rot.SourcePath, &rot.SourceIndex, &rot.IP,
+			&rot.Namespace, &rot.Name, &rot.Kind, &rot.SecretKey, &c.count, &lastStr)
+		if err != nil {
+			return nil, err
+		}
+		c.last, _ = time.Parse(time.RFC3339, lastStr)
+		counts[slotKey(*rot.cert())] = c
+	}
+	return counts, rows.Err()
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// escapeICS escapes a TEXT value (RFC 5545, section 3.3.11).
+func escapeICS(s string) string {
+	return icsEscaper.Replace(s)
+}
+
+// writeICSLine writes a content line, folded at 75 octets without
+// splitting UTF-8 sequences.
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
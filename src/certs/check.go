@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per minute, holding
+// at most rate tokens.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+var manualCheckLimiter = &rateLimiter{}
+
+// allow takes n tokens if they are available. Otherwise it returns how
+// long until they are. Requests for more tokens than the bucket holds are
+// let through once it is full and leave it in debt, so they still cost n.
+func (l *rateLimiter) allow(rate, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perToken := time.Minute / time.Duration(rate)
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens = math.Min(float64(rate), l.tokens+float64(now.Sub(l.last))/float64(perToken))
+	}
+	l.last = now
+
+	need := math.Min(float64(n), float64(rate))
+	if l.tokens < need {
+		return false, time.Duration((need - l.tokens) * float64(perToken))
+	}
+	l.tokens -= float64(n)
+	return true, 0
+}
+
+// CheckResult is the outcome of an on-demand check of one target.
+type CheckResult struct {
+	URL   string      `json:"url"`
+	Certs []*CertInfo `json:"certs,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// handleCheck checks a configured target right away:
+//
+//	POST /certs/check?target=example.com  checks one target, returns its CertInfo
+//	POST /certs/check                     checks every target, returns []CheckResult
+//
+// File and k8s targets return a list of CertInfo, one per certificate found,
+// as do targets with all_addresses, one per address that answered. The
+// addresses that did not are recorded as failures.
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Checking every target costs a token per target
+	cfg := currentConfig()
+	url := r.URL.Query().Get("target")
+	cost := 1
+	if url == "" {
+		cost = max(len(cfg.URLs), 1)
+	}
+	if ok, wait := manualCheckLimiter.allow(cfg.ManualCheckRate, cost); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many check requests", http.StatusTooManyRequests)
+		return
+	}
+
+	if url != "" {
+		target, ok := cfg.findTarget(url)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", url), http.StatusNotFound)
+			return
+		}
+
+		infos, err := checkOnce(target)
+		if len(infos) == 0 {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if target.onDisk() || target.AllAddresses {
+			json.NewEncoder(w).Encode(infos)
+		} else {
+			json.NewEncoder(w).Encode(infos[0])
+		}
+		return
+	}
+
+	var mu sync.Mutex
+	results := make([]CheckResult, 0, len(cfg.URLs))
+	checkPool(cfg.URLs, cfg.Concurrency, 0, func(target Target) {
+		result := CheckResult{URL: target.URL}
+		infos, err := checkOnce(target)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Certs = infos
+
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterCost(t *testing.T) {
+	l := &rateLimiter{}
+	if ok, _ := l.allow(10, 1); !ok {
+		t.Fatal("first check refused")
+	}
+
+	// A sweep of 30 targets waits for a full bucket
+	ok, wait := l.allow(10, 30)
+	if ok {
+		t.Fatal("sweep allowed with 9 tokens left")
+	}
+	if wait < 5*time.Second || wait > 6*time.Second {
+		t.Errorf("sweep waits %v, want about one token (6s)", wait)
+	}
+
+	l = &rateLimiter{}
+	if ok, _ := l.allow(10, 30); !ok {
+		t.Fatal("sweep refused with a full bucket")
+	}
+	// ... and leaves it 20 tokens in debt: 21 tokens until the next check
+	ok, wait = l.allow(10, 1)
+	if ok {
+		t.Fatal("check allowed right after a sweep")
+	}
+	if want := 21 * 6 * time.Second; wait < want-time.Second || wait > want {
+		t.Errorf("check after sweep waits %v, want about %v", wait, want)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Nagios plugin exit codes, as returned by `certs check`.
+const (
+	exitOK = iota
+	exitWarning
+	exitCritical
+	exitUnknown
+)
+
+var statusNames = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// CLIResult is the status of one certificate, or of a target that could
+// not be checked, in the output of `certs check`.
+type CLIResult struct {
+	URL        string    `json:"url"`
+	Status     string    `json:"status"`
+	Reason     string    `json:"reason,omitempty"`
+	Cert       *CertInfo `json:"cert,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	Error      string    `json:"error,omitempty"`
+
+	code int
+}
+
+// CLIReport is what `certs check -format json` prints.
+type CLIReport struct {
+	Status   string      `json:"status"`
+	ExitCode int         `json:"exit_code"`
+	Results  []CLIResult `json:"results"`
+}
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// runCheck implements `certs check`: it checks the given targets once,
+// prints the results and returns the exit code of a Nagios plugin.
+// Nothing is read from or written to certs.db.
+//
+//	certs check -target example.com -target smtp://mail.example.com -warn 30 -crit 7
+//	certs check -config config.json -format json
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	var urls stringList
+	fs.Var(&urls, "target", "target to check, written as in config.json (repeatable; also taken from the arguments)")
+	configPath := fs.String("config", "", "check the targets of this config file, or only those named by -target, with their settings")
+	warn := fs.Int("warn", 30, "WARNING when a certificate has fewer days remaining")
+	crit := fs.Int("crit", 7, "CRITICAL when a certificate has fewer days remaining")
+	format := fs.String("format", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return exitUnknown
+	}
+	urls = append(urls, fs.Args()...)
+
+	if *format != "table" && *format != "json" {
+		fmt.Printf("CERTS UNKNOWN - unknown format %q\n", *format)
+		return exitUnknown
+	}
+
+	cfg, targets, err := cliTargets(*configPath, urls)
+	if err != nil {
+		fmt.Printf("CERTS UNKNOWN - %v\n", err)
+		return exitUnknown
+	}
+
+	results := checkWithoutStoring(targets, cfg.Concurrency)
+	report := CLIReport{Status: statusNames[exitOK]}
+	for _, target := range targets {
+		res := results[target.URL]
+		if res.err != nil {
+			report.Results = append(report.Results, CLIResult{
+				URL:        target.URL,
+				Status:     statusNames[exitCritical],
+				ErrorClass: classifyError(res.err),
+				Error:      res.err.Error(),
+				code:       exitCritical,
+			})
+		}
+		for _, info := range res.infos {
+			info.DiscoveredFrom = target.DiscoveredFrom
+			report.Results = append(report.Results, certStatus(info, *warn, *crit))
+		}
+	}
+	for _, r := range report.Results {
+		report.ExitCode = max(report.ExitCode, r.code)
+	}
+	report.Status = statusNames[report.ExitCode]
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printCheckTable(report, *warn, *crit)
+	}
+	return report.ExitCode
+}
+
+// cliTargets returns the targets named on the command line, taking their
+// settings from the config at configPath if given. Without any names,
+// every target of the config is returned.
+func cliTargets(configPath string, urls []string) (Config, []Target, error) {
+	var cfg Config
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath); err != nil {
+			return cfg, nil, err
+		}
+		cfg = withDiscovered(cfg)
+		if len(urls) == 0 {
+			return cfg, cfg.URLs, nil
+		}
+	} else {
+		cfg.applyDefaults()
+	}
+	if len(urls) == 0 {
+		return cfg, nil, fmt.Errorf("no targets given")
+	}
+
+	var targets []Target
+	for _, url := range urls {
+		if t, ok := cfg.findTarget(url); ok {
+			targets = append(targets, t)
+			continue
+		}
+		t := Target{URL: url}
+		if err := t.parse(); err != nil {
+			return cfg, nil, err
+		}
+		t.inherit(cfg)
+		targets = append(targets, t)
+	}
+	return cfg, targets, nil
+}
+
+type cliCheck struct {
+	infos []*CertInfo
+	err   error
+}
+
+// checkWithoutStoring checks targets, concurrency at a time, and returns
+// the results by URL.
+func checkWithoutStoring(targets []Target, concurrency int) map[string]cliCheck {
+	var mu sync.Mutex
+	results := make(map[string]cliCheck)
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target Target) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			infos, err := getCertInfos(target)
+			mu.Lock()
+			results[target.URL] = cliCheck{infos, err}
+			mu.Unlock()
+		}(target)
+	}
+	wg.Wait()
+	return results
+}
+
+// certStatus rates a certificate the way the service reports problems:
+// expired, revoked, untrusted or mismatched certificates are CRITICAL,
+// as are those with fewer than crit days left.
+func certStatus(info *CertInfo, warn, crit int) CLIResult {
+	res := CLIResult{URL: info.URL, Cert: info, code: exitOK}
+	switch {
+	case info.ValidUntil.Before(info.CheckedAt):
+		res.code, res.Reason = exitCritical, "expired on "+info.ValidUntil.Format("2006-01-02")
+	case info.RevocationStatus == RevocationRevoked:
+		res.code, res.Reason = exitCritical, "revoked"
+		if info.RevocationReason != "" {
+			res.Reason += " (" + info.RevocationReason + ")"
+		}
+	case info.fromNetwork() && !info.ChainValid:
+		res.code, res.Reason = exitCritical, "chain does not verify: "+info.ChainError
+	case info.HostnameMatch != nil && !*info.HostnameMatch:
+		res.code, res.Reason = exitCritical, "hostname mismatch: "+info.HostnameError
+	case info.DaysRemaining < crit:
+		res.code, res.Reason = exitCritical, fmt.Sprintf("expires in %d days", info.DaysRemaining)
+	case info.DaysRemaining < warn:
+		res.code, res.Reason = exitWarning, fmt.Sprintf("expires in %d days", info.DaysRemaining)
+	}
+	res.Status = statusNames[res.code]
+	return res
+}
+
+// printCheckTable prints the plugin output: a status line with the days
+// remaining of every certificate as perfdata, followed by a table.
+func printCheckTable(report CLIReport, warn, crit int) {
+	counts := make([]int, len(statusNames))
+	var perfdata []string
+	for _, r := range report.Results {
+		counts[r.code]++
+		if r.Cert != nil {
+			label := strings.ReplaceAll(certSubject(r.Cert), "'", "''")
+			perfdata = append(perfdata, fmt.Sprintf("'%s'=%d;%d:;%d:", label, r.Cert.DaysRemaining, warn, crit))
+		}
+	}
+
+	line := fmt.Sprintf("CERTS %s - %d critical, %d warning, %d ok",
+		report.Status, counts[exitCritical], counts[exitWarning], counts[exitOK])
+	if len(perfdata) > 0 {
+		line += " | " + strings.Join(perfdata, " ")
+	}
+	fmt.Println(line)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tTARGET\tDAYS\tVALID UNTIL\tISSUER\tDETAIL")
+	for _, r := range report.Results {
+		if r.Cert == nil {
+			fmt.Fprintf(tw, "%s\t%s\t\t\t\t%s: %s\n", r.Status, r.URL, r.ErrorClass, r.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", r.Status, certSubject(r.Cert), r.Cert.DaysRemaining,
+			r.Cert.ValidUntil.Format("2006-01-02"), r.Cert.IssuedBy, r.Reason)
+	}
+	tw.Flush()
+}
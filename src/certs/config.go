@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Config struct {
+	URLs []Target `json:"urls"`
+
+	// Concurrency is the number of targets checked in parallel.
+	Concurrency int `json:"concurrency,omitempty"`
+	// DialTimeout and HandshakeTimeout apply to every target that does not
+	// set its own.
+	DialTimeout      Duration `json:"dial_timeout,omitempty"`
+	HandshakeTimeout Duration `json:"handshake_timeout,omitempty"`
+	// Interval is how often each target is checked. Once a certificate is
+	// within WarningDays of expiry it is checked every WarningInterval
+	// instead. All three can be overridden per target.
+	Interval        Duration `json:"interval,omitempty"`
+	WarningDays     int      `json:"warning_days,omitempty"`
+	WarningInterval Duration `json:"warning_interval,omitempty"`
+	// TLSScanInterval is how often the protocol versions and cipher suites
+	// each endpoint accepts are inventoried. It can be overridden per target.
+	TLSScanInterval Duration `json:"tls_scan_interval,omitempty"`
+	// ManualCheckRate is how many on-demand checks /certs/check accepts per
+	// minute. Checking every target counts as one check per target.
+	ManualCheckRate int `json:"manual_check_rate,omitempty"`
+	// Jitter is the upper bound of the random delay before each check, so
+	// a sweep doesn't hit every endpoint at the same moment.
+	Jitter *Duration `json:"jitter,omitempty"`
+	// RetentionDays is how long every check is kept. Older history is
+	// thinned out to the last check of each certificate per day.
+	RetentionDays int `json:"retention_days,omitempty"`
+	// CalendarAlarmDays are the reminders, in days before expiry, added
+	// to every event of /certs/calendar.ics.
+	CalendarAlarmDays []int `json:"calendar_alarm_days,omitempty"`
+	// Discovery lists sources targets are read from in addition to URLs,
+	// every DiscoveryInterval. See discovery.go.
+	Discovery         []DiscoveryConfig `json:"discovery,omitempty"`
+	DiscoveryInterval Duration          `json:"discovery_interval,omitempty"`
+	// Notifications are sent for expiring, expired, revoked and
+	// unreachable certificates when set. See notify.go.
+	Notifications *NotifyConfig `json:"notifications,omitempty"`
+}
+
+const (
+	defaultConcurrency      = 10
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultJitter           = 2 * time.Second
+	defaultInterval         = 24 * time.Hour
+	defaultWarningDays      = 30
+	defaultWarningInterval  = time.Hour
+	defaultManualCheckRate  = 10
+	defaultTLSScanInterval  = 7 * 24 * time.Hour
+	defaultRetentionDays    = 90
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+var (
+	configMu sync.RWMutex
+	config   Config
+	// configChanged is closed and replaced by every setConfig.
+	configChanged = make(chan struct{})
+)
+
+// currentConfig returns the configuration the service is running with.
+func currentConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+func setConfig(cfg Config) {
+	configMu.Lock()
+	config = cfg
+	close(configChanged)
+	configChanged = make(chan struct{})
+	configMu.Unlock()
+}
+
+// configReloaded returns a channel that is closed when the configuration
+// is next replaced. Workers take it before reading currentConfig, so they
+// don't miss a reload.
+func configReloaded() <-chan struct{} {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return configChanged
+}
+
+// sleepOrReload waits for d, or until reloaded is closed.
+func sleepOrReload(d time.Duration, reloaded <-chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-reloaded:
+	}
+}
+
+// hasTarget reports whether url is one of the configured targets. Results
+// of targets removed from the config are kept in the database but no
+// longer reported.
+func (cfg Config) hasTarget(url string) bool {
+	_, ok := cfg.findTarget(url)
+	return ok
+}
+
+// findTarget returns the configured target whose URL is exactly url.
+func (cfg Config) findTarget(url string) (Target, bool) {
+	for _, t := range cfg.URLs {
+		if t.URL == url {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
+
+// Duration is a time.Duration written in config.json as a string such as
+// "30s" or "24h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaultConfigPath is where the config is read from unless -config or
+// CERTS_CONFIG say otherwise.
+func defaultConfigPath() string {
+	if path := os.Getenv("CERTS_CONFIG"); path != "" {
+		return path
+	}
+	return "./config.json"
+}
+
+// loadConfig reads and validates the config at path.
+func loadConfig(path string) (Config, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(f, &cfg); err != nil {
+		return Config{}, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	cfg.applyDefaults()
+	for _, d := range cfg.Discovery {
+		if err := d.validate(); err != nil {
+			return Config{}, err
+		}
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.URLs {
+		if err := cfg.URLs[i].parse(); err != nil {
+			return Config{}, err
+		}
+		if seen[cfg.URLs[i].URL] {
+			return Config{}, fmt.Errorf("duplicate target %q", cfg.URLs[i].URL)
+		}
+		seen[cfg.URLs[i].URL] = true
+		cfg.URLs[i].inherit(cfg)
+	}
+	return cfg, nil
+}
+
+// watchConfig reloads the config at path on SIGHUP and whenever the file
+// changes. An invalid config is logged and the running one kept.
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(path)
+	for {
+		select {
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading %s", path)
+		case <-ticker.C:
+			if fileModTime(path).Equal(modTime) {
+				continue
+			}
+			log.Printf("%s changed, reloading", path)
+		}
+		modTime = fileModTime(path)
+
+		cfg, err := loadConfig(path)
+		if err != nil {
+			log.Printf("Invalid config in %s, keeping the previous one: %v", path, err)
+			continue
+		}
+		applyConfig(cfg)
+		log.Printf("Reloaded %s with %d targets", path, len(currentConfig().URLs))
+	}
+}
+
+// fileModTime returns the modification time of path, or the zero time if
+// it can't be read.
+func fileModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func (cfg *Config) applyDefaults() {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = Duration(defaultDialTimeout)
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = Duration(defaultHandshakeTimeout)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = Duration(defaultInterval)
+	}
+	if cfg.WarningDays <= 0 {
+		cfg.WarningDays = defaultWarningDays
+	}
+	if cfg.WarningInterval <= 0 {
+		cfg.WarningInterval = Duration(defaultWarningInterval)
+	}
+	if cfg.TLSScanInterval <= 0 {
+		cfg.TLSScanInterval = Duration(defaultTLSScanInterval)
+	}
+	if cfg.ManualCheckRate <= 0 {
+		cfg.ManualCheckRate = defaultManualCheckRate
+	}
+	if cfg.RetentionDays <= 0 {
+		cfg.RetentionDays = defaultRetentionDays
+	}
+	if cfg.DiscoveryInterval <= 0 {
+		cfg.DiscoveryInterval = Duration(defaultDiscoveryInterval)
+	}
+	if len(cfg.CalendarAlarmDays) == 0 {
+		cfg.CalendarAlarmDays = append([]int(nil), defaultCalendarAlarmDays...)
+	}
+	if cfg.Jitter == nil {
+		jitter := Duration(defaultJitter)
+		cfg.Jitter = &jitter
+	}
+	if cfg.Notifications != nil {
+		cfg.Notifications.applyDefaults()
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The Grafana JSON datasource protocol, served at the root of the service:
+//
+//	GET  /             health check
+//	POST /search       lists the targets, for template variables
+//	POST /query        days remaining over time for each requested target
+//	POST /annotations  rotations and failed checks in the requested range
+
+// queryRange is the time range Grafana sends with every request.
+type queryRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type searchRequest struct {
+	Target string `json:"target"`
+}
+
+type queryRequest struct {
+	Range   queryRange `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+type annotationRequest struct {
+	Range      queryRange      `json:"range"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// TimeSeries is a series in the format Grafana's JSON datasources read.
+type TimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // value, Unix milliseconds
+}
+
+// datasourceAnnotation is an Annotation along with the annotation query it
+// answers, which the datasource protocol echoes back.
+type datasourceAnnotation struct {
+	Query json.RawMessage `json:"annotation"`
+	Annotation
+}
+
+func handleDatasourceRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// decodeDatasourceRequest reads the JSON body of a datasource request into
+// v, replying with an error if the request is not a valid POST.
+func decodeDatasourceRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// handleSearch lists the configured targets and every target with recorded
+// checks, optionally filtered by the substring in the request.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	var req searchRequest
+	if !decodeDatasourceRequest(w, r, &req) {
+		return
+	}
+
+	urls, err := knownTargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := []string{}
+	for _, url := range urls {
+		if strings.Contains(url, req.Target) {
+			results = append(results, url)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// knownTargets returns the URLs of the configured targets and of any
+// target with checks in the database, sorted.
+func knownTargets() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, target := range currentConfig().URLs {
+		seen[target.URL] = true
+	}
+
+	rows, err := db.Query("SELECT DISTINCT url FROM cert_checks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		seen[url] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(seen))
+	for url := range seen {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// handleQuery returns the days remaining of each requested target over the
+// requested range. Targets on disk yield one series per certificate, and
+// targets checked per address one series per address.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req queryRequest
+	if !decodeDatasourceRequest(w, r, &req) {
+		return
+	}
+
+	response := []TimeSeries{}
+	for _, t := range req.Targets {
+		if t.Target == "" {
+			continue
+		}
+		series, err := loadDaysRemaining(t.Target, req.Range.From, req.Range.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response = append(response, series...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// loadDaysRemaining returns the days remaining recorded by every check of
+// url between from and to, one series per certificate.
+func loadDaysRemaining(url string, from, to time.Time) ([]TimeSeries, error) {
+	rows, err := db.Query(`
+    SELECT COALESCE(source_path, ''), COALESCE(source_index, 0), COALESCE(ip, ''),
+        COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, ''),
+        days_remaining, checked_at
+    FROM cert_checks
+    WHERE url = ? AND checked_at >= ? AND checked_at <= ?
+    ORDER BY checked_at, id`,
+		url, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []TimeSeries
+	index := make(map[string]int)
+	for rows.Next() {
+		info := CertInfo{URL: url}
+		var checkedAtStr string
+		var days int
+		err := rows.Scan(&info.SourcePath, &info.SourceIndex, &info.IP,
+			&info.Namespace, &info.Name, &info.Kind, &info.SecretKey, &days, &checkedAtStr)
+		if err != nil {
+			return nil, err
+		}
+		checkedAt, _ := time.Parse(time.RFC3339, checkedAtStr)
+
+		name := certSubject(&info)
+		i, ok := index[name]
+		if !ok {
+			i = len(series)
+			index[name] = i
+			series = append(series, TimeSeries{Target: name, Datapoints: [][2]float64{}})
+		}
+		series[i].Datapoints = append(series[i].Datapoints, [2]float64{float64(days), float64(checkedAt.UnixMilli())})
+	}
+	return series, rows.Err()
+}
+
+// handleDatasourceAnnotations returns rotations and failed checks in the
+// requested range, optionally limited to the target named by the
+// annotation query.
+func handleDatasourceAnnotations(w http.ResponseWriter, r *http.Request) {
+	var req annotationRequest
+	if !decodeDatasourceRequest(w, r, &req) {
+		return
+	}
+	var query struct {
+		Query string `json:"query"` // a target URL, or empty for all
+	}
+	if len(req.Annotation) > 0 {
+		if err := json.Unmarshal(req.Annotation, &query); err != nil {
+			http.Error(w, fmt.Sprintf("invalid annotation: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	url := strings.TrimSpace(query.Query)
+	rotations, err := loadRotations(url, req.Range.From, req.Range.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outages, err := loadOutages(url, req.Range.From, req.Range.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	annotations := make([]datasourceAnnotation, 0, len(rotations)+len(outages))
+	for _, rot := range rotations {
+		annotations = append(annotations, datasourceAnnotation{req.Annotation, rotationAnnotation(rot)})
+	}
+	for _, o := range outages {
+		annotations = append(annotations, datasourceAnnotation{req.Annotation, outageAnnotation(o)})
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		return annotations[i].Time < annotations[j].Time
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations)
+}
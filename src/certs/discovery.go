@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Discovery source types.
+const (
+	DiscoveryFileSD     = "file_sd"    // Prometheus file_sd JSON or YAML files
+	DiscoveryKubernetes = "kubernetes" // Ingress and Gateway manifests
+	DiscoveryNginx      = "nginx"      // server blocks listening with ssl
+	DiscoveryHAProxy    = "haproxy"    // frontends binding with ssl
+)
+
+const defaultDiscoveryInterval = 5 * time.Minute
+
+// DiscoveryConfig is a source of targets checked in addition to the static
+// urls of the config. Path may be a file, a directory or a glob, like file
+// targets.
+//
+// Discovered targets are checked with the global settings and report the
+// source they came from as discovered_from. A static target with the same
+// URL takes precedence.
+type DiscoveryConfig struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+func (d DiscoveryConfig) validate() error {
+	switch d.Type {
+	case DiscoveryFileSD, DiscoveryKubernetes, DiscoveryNginx, DiscoveryHAProxy:
+	default:
+		return fmt.Errorf("unknown discovery type %q", d.Type)
+	}
+	if d.Path == "" {
+		return fmt.Errorf("%s discovery needs a path", d.Type)
+	}
+	return nil
+}
+
+var (
+	discoveryMu sync.Mutex
+	// fileConfig is the config as read from the file, before discovered
+	// targets are merged in.
+	fileConfig Config
+	// discovered holds the last targets read from each source, which are
+	// kept while the source can't be read.
+	discovered = make(map[DiscoveryConfig][]Target)
+)
+
+// applyConfig makes cfg, with the targets of its discovery sources merged
+// in, the running configuration.
+func applyConfig(cfg Config) {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+
+	fileConfig = cfg
+	setConfig(withDiscovered(cfg))
+}
+
+// discoveryWorker re-reads the discovery sources every discovery_interval
+// and updates the running configuration when the targets changed.
+func discoveryWorker() {
+	for {
+		time.Sleep(time.Duration(currentConfig().DiscoveryInterval))
+
+		discoveryMu.Lock()
+		if len(fileConfig.Discovery) > 0 {
+			cfg := withDiscovered(fileConfig)
+			if !reflect.DeepEqual(cfg.URLs, currentConfig().URLs) {
+				setConfig(cfg)
+				log.Printf("Discovered targets changed, now checking %d targets", len(cfg.URLs))
+			}
+		}
+		discoveryMu.Unlock()
+	}
+}
+
+// withDiscovered returns cfg with the targets of its discovery sources
+// appended to URLs. The service calls it with discoveryMu held.
+func withDiscovered(cfg Config) Config {
+	seen := make(map[string]bool)
+	for _, t := range cfg.URLs {
+		seen[t.URL] = true
+	}
+
+	urls := append([]Target(nil), cfg.URLs...)
+	for _, source := range cfg.Discovery {
+		targets, err := source.discover()
+		if err != nil {
+			log.Printf("Error discovering targets from %s, keeping the %d found before: %v",
+				source.Path, len(discovered[source]), err)
+			targets = discovered[source]
+		} else {
+			discovered[source] = targets
+		}
+
+		for _, t := range targets {
+			if seen[t.URL] {
+				continue
+			}
+			seen[t.URL] = true
+			t.inherit(cfg)
+			urls = append(urls, t)
+		}
+	}
+	cfg.URLs = urls
+	return cfg
+}
+
+// discover reads the targets listed in the files under d.Path.
+func (d DiscoveryConfig) discover() ([]Target, error) {
+	paths, err := expandPath(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	for _, path := range paths {
+		var found []Target
+		switch d.Type {
+		case DiscoveryFileSD:
+			found, err = readFileSD(path)
+		case DiscoveryKubernetes:
+			found, err = readKubeHosts(path)
+		case DiscoveryNginx:
+			found, err = readNginxHosts(path)
+		case DiscoveryHAProxy:
+			found, err = readHAProxyHosts(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		for _, t := range found {
+			if err := t.parse(); err != nil {
+				log.Printf("Ignoring target %q discovered in %s: %v", t.URL, path, err)
+				continue
+			}
+			t.DiscoveredFrom = d.Type + ":" + path
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// hostURL writes host and port as a target URL, leaving out the default
+// port so that discovered targets match static ones written as bare hosts.
+// IPv6 addresses are bracketed when a port follows.
+func hostURL(host string, port int) string {
+	if port == defaultPort || port == 0 {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// checkableHost reports whether name is a concrete hostname, as opposed to
+// a wildcard, regular expression, variable or catch-all.
+func checkableHost(name string) bool {
+	return name != "" && name != "_" && !strings.ContainsAny(name, "*~$^()/")
+}
+
+func hasManifestExt(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+type fileSDGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// readFileSD returns the targets of a Prometheus file_sd file, labelled
+// with the labels of their group. JSON is read by the YAML decoder as well.
+func readFileSD(path string) ([]Target, error) {
+	if !hasManifestExt(path) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []fileSDGroup
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	for _, g := range groups {
+		// Prometheus drops labels starting with __ after relabelling
+		labels := make(map[string]string)
+		for name, value := range g.Labels {
+			if !strings.HasPrefix(name, "__") {
+				labels[name] = value
+			}
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		for _, url := range g.Targets {
+			targets = append(targets, Target{URL: url, Labels: labels})
+		}
+	}
+	return targets, nil
+}
+
+// readKubeHosts returns the TLS hosts of the Ingresses (spec.tls[].hosts)
+// and the HTTPS and TLS listeners of the Gateways in a manifest file.
+func readKubeHosts(path string) ([]Target, error) {
+	if !hasManifestExt(path) {
+		return nil, nil
+	}
+	objects, err := readManifests(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	for _, obj := range objects {
+		switch {
+		case obj.Kind == "Ingress":
+			for _, tls := range obj.Spec.TLS {
+				for _, host := range tls.Hosts {
+					if checkableHost(host) {
+						targets = append(targets, Target{URL: host})
+					}
+				}
+			}
+		case obj.Kind == "Gateway" && strings.HasPrefix(obj.APIVersion, "gateway.networking.k8s.io/"):
+			for _, l := range obj.Spec.Listeners {
+				if (l.Protocol == "HTTPS" || l.Protocol == "TLS") && checkableHost(l.Hostname) {
+					targets = append(targets, Target{URL: hostURL(l.Hostname, l.Port)})
+				}
+			}
+		}
+	}
+	return targets, nil
+}
+
+// readNginxHosts returns a target for every server_name and ssl port of
+// the server blocks in an nginx config file. Included files are not
+// followed; point path at them as well.
+func readNginxHosts(path string) ([]Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type server struct {
+		names []string
+		ports []int
+		sslOn bool // the pre-1.15 "ssl on;" directive
+		plain []int
+	}
+
+	var targets []Target
+	var blocks []string // names of the enclosing blocks
+	var srv *server
+	var words []string
+	for _, tok := range nginxTokens(string(data)) {
+		switch tok {
+		case "{":
+			name := ""
+			if len(words) > 0 {
+				name = words[0]
+			}
+			blocks = append(blocks, name)
+			if name == "server" {
+				srv = &server{}
+			}
+			words = nil
+		case "}":
+			if len(blocks) > 0 && blocks[len(blocks)-1] == "server" && srv != nil {
+				ports := srv.ports
+				if srv.sslOn {
+					ports = append(ports, srv.plain...)
+				}
+				for _, name := range srv.names {
+					for _, port := range ports {
+						targets = append(targets, Target{URL: hostURL(name, port)})
+					}
+				}
+				srv = nil
+			}
+			if len(blocks) > 0 {
+				blocks = blocks[:len(blocks)-1]
+			}
+			words = nil
+		case ";":
+			if srv != nil && len(words) > 0 && blocks[len(blocks)-1] == "server" {
+				switch words[0] {
+				case "server_name":
+					for _, name := range words[1:] {
+						if checkableHost(name) {
+							srv.names = append(srv.names, name)
+						}
+					}
+				case "listen":
+					// IPv4 and IPv6 listens usually share a port
+					if port, ssl, ok := parseNginxListen(words[1:]); ok {
+						if ssl && !slices.Contains(srv.ports, port) {
+							srv.ports = append(srv.ports, port)
+						} else if !ssl && !slices.Contains(srv.plain, port) {
+							srv.plain = append(srv.plain, port)
+						}
+					}
+				case "ssl":
+					srv.sslOn = len(words) > 1 && words[1] == "on"
+				}
+			}
+			words = nil
+		default:
+			words = append(words, tok)
+		}
+	}
+	return targets, nil
+}
+
+// parseNginxListen returns the port of a listen directive and whether it
+// has the ssl parameter.
+func parseNginxListen(args []string) (port int, ssl bool, ok bool) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "unix:") {
+		return 0, false, false
+	}
+	for _, arg := range args[1:] {
+		if arg == "ssl" {
+			ssl = true
+		}
+	}
+
+	addr := args[0]
+	if i := strings.LastIndex(addr, ":"); i >= 0 && !strings.HasSuffix(addr, "]") {
+		addr = addr[i+1:]
+	} else if _, err := strconv.Atoi(addr); err != nil {
+		// an address without a port
+		return 80, ssl, true
+	}
+	port, err := strconv.Atoi(addr)
+	if err != nil {
+		return 0, false, false
+	}
+	return port, ssl, true
+}
+
+// nginxTokens splits an nginx config into words, "{", "}" and ";",
+// dropping comments and quotes.
+func nginxTokens(s string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	var quote rune
+	comment := false
+	for _, c := range s {
+		switch {
+		case comment:
+			comment = c != '\n'
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			flush()
+			comment = true
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		default:
+			word.WriteRune(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// haproxySections are the keywords that start a section of an HAProxy
+// config.
+var haproxySections = map[string]bool{
+	"global": true, "defaults": true, "frontend": true, "backend": true, "listen": true,
+	"resolvers": true, "peers": true, "userlist": true, "mailers": true, "program": true,
+	"http-errors": true, "cache": true, "ring": true,
+}
+
+// haproxyHostFetches are the sample fetches whose ACL patterns are the
+// hostnames a frontend serves.
+var haproxyHostFetches = map[string]bool{
+	"hdr(host)": true, "hdr_dom(host)": true, "req.hdr(host)": true,
+	"ssl_fc_sni": true, "req.ssl_sni": true, "req_ssl_sni": true,
+}
+
+// readHAProxyHosts returns a target for every hostname matched in the ACLs
+// of the frontend and listen sections that bind with ssl, on each of their
+// ssl ports. Sections without such ACLs yield their bind address, when it
+// isn't a wildcard.
+func readHAProxyHosts(path string) ([]Target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type bind struct {
+		host string
+		port int
+	}
+
+	var targets []Target
+	var binds []bind
+	var names []string
+	flush := func() {
+		if len(names) == 0 {
+			for _, b := range binds {
+				if b.host != "" {
+					targets = append(targets, Target{URL: hostURL(b.host, b.port)})
+				}
+			}
+		}
+		for _, name := range names {
+			for _, b := range binds {
+				targets = append(targets, Target{URL: hostURL(name, b.port)})
+			}
+		}
+		binds, names = nil, nil
+	}
+
+	inFrontend := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if haproxySections[fields[0]] {
+			flush()
+			inFrontend = fields[0] == "frontend" || fields[0] == "listen"
+			continue
+		}
+		if !inFrontend {
+			continue
+		}
+
+		if fields[0] == "bind" && len(fields) > 1 {
+			ssl := false
+			for _, arg := range fields[2:] {
+				if arg == "ssl" {
+					ssl = true
+				}
+			}
+			if !ssl {
+				continue
+			}
+			for _, addr := range strings.Split(fields[1], ",") {
+				if host, port, ok := parseHAProxyBind(addr); ok {
+					binds = append(binds, bind{host, port})
+				}
+			}
+			continue
+		}
+
+		for i, field := range fields {
+			if !haproxyHostFetches[field] {
+				continue
+			}
+			for _, v := range fields[i+1:] {
+				if v == "}" || v == "||" || v == "or" {
+					break
+				}
+				if strings.HasPrefix(v, "-") || !strings.Contains(v, ".") {
+					continue
+				}
+				if host, _, found := strings.Cut(v, ":"); found {
+					v = host
+				}
+				if checkableHost(v) {
+					names = append(names, v)
+				}
+			}
+		}
+	}
+	flush()
+	return targets, scanner.Err()
+}
+
+// parseHAProxyBind splits a bind address such as "*:443", ":::8443",
+// "10.0.0.1:443" or "ipv6@:443". Wildcard addresses have an empty host.
+func parseHAProxyBind(addr string) (host string, port int, ok bool) {
+	if _, rest, found := strings.Cut(addr, "@"); found {
+		addr = rest
+	}
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(addr[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	host = strings.Trim(addr[:i], "[]")
+	switch host {
+	case "", "*", "0.0.0.0", "::", ":":
+		host = ""
+	}
+	return host, port, true
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseHAProxyBind(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+		ok   bool
+	}{
+		{"*:443", "", 443, true},
+		{":443", "", 443, true},
+		{"0.0.0.0:443", "", 443, true},
+		{":::8443", "", 8443, true},
+		{"[::]:443", "", 443, true},
+		{"10.0.0.1:443", "10.0.0.1", 443, true},
+		{"2001:db8::1:8443", "2001:db8::1", 8443, true},
+		{"[2001:db8::1]:8443", "2001:db8::1", 8443, true},
+		{"ipv6@:443", "", 443, true},
+		{"ipv4@10.0.0.1:636", "10.0.0.1", 636, true},
+		{"/var/run/haproxy.sock", "", 0, false},
+		{"10.0.0.1:https", "", 0, false},
+	}
+	for _, tt := range tests {
+		host, port, ok := parseHAProxyBind(tt.addr)
+		if host != tt.host || port != tt.port || ok != tt.ok {
+			t.Errorf("parseHAProxyBind(%q) = %q, %d, %v, want %q, %d, %v",
+				tt.addr, host, port, ok, tt.host, tt.port, tt.ok)
+		}
+	}
+}
+
+func TestParseNginxListen(t *testing.T) {
+	tests := []struct {
+		args []string
+		port int
+		ssl  bool
+		ok   bool
+	}{
+		{[]string{"443", "ssl"}, 443, true, true},
+		{[]string{"443", "ssl", "http2"}, 443, true, true},
+		{[]string{"80"}, 80, false, true},
+		{[]string{"*:8443", "ssl"}, 8443, true, true},
+		{[]string{"[::]:443", "ssl"}, 443, true, true},
+		{[]string{"10.0.0.1:9443", "default_server", "ssl"}, 9443, true, true},
+		{[]string{"localhost"}, 80, false, true},
+		{[]string{"[::1]"}, 80, false, true},
+		{[]string{"unix:/run/nginx.sock", "ssl"}, 0, false, false},
+		{nil, 0, false, false},
+	}
+	for _, tt := range tests {
+		port, ssl, ok := parseNginxListen(tt.args)
+		if port != tt.port || ssl != tt.ssl || ok != tt.ok {
+			t.Errorf("parseNginxListen(%q) = %d, %v, %v, want %d, %v, %v",
+				tt.args, port, ssl, ok, tt.port, tt.ssl, tt.ok)
+		}
+	}
+}
+
+func TestReadNginxHosts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name: "ssl ports only",
+			config: `
+server {
+    listen 80;
+    listen 443 ssl http2; # comment
+    listen [::]:443 ssl;
+    listen 8443 ssl;
+    server_name example.com "www.example.com";
+}`,
+			want: []string{"example.com", "example.com:8443", "www.example.com", "www.example.com:8443"},
+		},
+		{
+			name: "plain server",
+			config: `
+server {
+    listen 80;
+    server_name plain.example.com;
+}`,
+		},
+		{
+			name: "ssl on",
+			config: `
+server {
+    listen 10.0.0.5:9443;
+    ssl on;
+    server_name old.example.com;
+}`,
+			want: []string{"old.example.com:9443"},
+		},
+		{
+			name: "wildcards, regexes and catch-all skipped",
+			config: `
+server {
+    listen 443 ssl;
+    server_name _ *.example.com ~^(?<sub>.+)\.example\.com$ $hostname api.example.com;
+}`,
+			want: []string{"api.example.com"},
+		},
+		{
+			name: "nested blocks",
+			config: `
+http {
+    upstream app { server 10.0.0.1:8080; }
+    server {
+        listen 443 ssl;
+        location / {
+            proxy_pass http://app;
+            server_name ignored.example.com;
+        }
+        server_name app.example.com;
+    }
+}
+stream {
+    server {
+        listen 636 ssl;
+        proxy_pass ldap;
+    }
+}`,
+			want: []string{"app.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "nginx.conf")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			targets, err := readNginxHosts(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, target := range targets {
+				got = append(got, target.URL)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("readNginxHosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostURL(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"example.com", 443, "example.com"},
+		{"example.com", 8443, "example.com:8443"},
+		{"2001:db8::1", 443, "2001:db8::1"},
+		{"2001:db8::1", 8443, "[2001:db8::1]:8443"},
+	}
+	for _, tt := range tests {
+		got := hostURL(tt.host, tt.port)
+		if got != tt.want {
+			t.Errorf("hostURL(%q, %d) = %q, want %q", tt.host, tt.port, got, tt.want)
+			continue
+		}
+
+		// The URL must parse back to the same host and port.
+		target := Target{URL: got}
+		if err := target.parse(); err != nil {
+			t.Errorf("parsing %q: %v", got, err)
+		} else if target.Host != tt.host || target.Port != tt.port {
+			t.Errorf("%q parses as %q, %d, want %q, %d", got, target.Host, target.Port, tt.host, tt.port)
+		}
+	}
+}
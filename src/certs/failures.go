@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// CheckFailure is a check of a target that did not return a certificate.
+type CheckFailure struct {
+	ID         int64     `json:"-"`
+	URL        string    `json:"url"`
+	IP         string    `json:"ip,omitempty"` // set when one of the addresses of the target failed
+	CheckedAt  time.Time `json:"checked_at"`
+	ErrorClass string    `json:"error_class"` // see probe.go
+	Error      string    `json:"error"`
+}
+
+// TargetFailure describes a target, or one of its addresses, whose checks
+// have been failing since its last successful check.
+type TargetFailure struct {
+	CheckFailure
+	FailingSince time.Time `json:"failing_since"`
+	Failures     int       `json:"failures"` // consecutive failed checks
+}
+
+func storeCheckFailure(f *CheckFailure) error {
+	res, err := db.Exec(
+		"INSERT INTO check_failures (url, ip, checked_at, error_class, error) VALUES (?, ?, ?, ?, ?)",
+		f.URL, f.IP, f.CheckedAt.UTC().Format(time.RFC3339), f.ErrorClass, f.Error,
+	)
+	if err != nil {
+		return err
+	}
+
+	f.ID, err = res.LastInsertId()
+	return err
+}
+
+// recordFailures stores a failed check of url, one failure per address
+// that failed, and sends the unreachable events.
+func recordFailures(url string, checkedAt time.Time, checkErr error) {
+	for _, addrErr := range failedAddresses(checkErr) {
+		f := &CheckFailure{
+			URL:        url,
+			IP:         addrErr.IP,
+			CheckedAt:  checkedAt,
+			ErrorClass: classifyError(addrErr.Err),
+			Error:      addrErr.Err.Error(),
+		}
+		if err := storeCheckFailure(f); err != nil {
+			log.Printf("Error storing failed check of %s: %v", url, err)
+			continue
+		}
+		notifyFailure(f)
+	}
+}
+
+// failingSince returns the first failed check of url at ip (or of the
+// whole target when ip is empty) since its last successful check.
+func failingSince(url, ip string) (time.Time, error) {
+	var sinceStr sql.NullString
+	err := db.QueryRow(`
+    SELECT MIN(checked_at) FROM check_failures
+    WHERE url = ? AND COALESCE(ip, '') = ? AND checked_at > COALESCE((
+        SELECT MAX(checked_at) FROM cert_checks WHERE url = ? AND (? = '' OR ip = ?)
+    ), '')`,
+		url, ip, url, ip, ip,
+	).Scan(&sinceStr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	since, _ := time.Parse(time.RFC3339, sinceStr.String)
+	return since, nil
+}
+
+// lastSuccessQuery selects the last successful check of the target or
+// address of the failure f. A failure without an IP ends with a success
+// of any address, one of an address only with a success of that address.
+const lastSuccessQuery = `
+    SELECT MAX(c.checked_at) FROM cert_checks c
+    WHERE c.url = f.url AND (COALESCE(f.ip, '') = '' OR c.ip = f.ip)`
+
+// currentFailures returns the configured targets, and the addresses of
+// targets checked with AllAddresses, whose checks failed since their last
+// successful check, with the most recent failure, ordered by URL and IP.
+// An address only counts while it failed in the latest check of its
+// target.
+func currentFailures() ([]*TargetFailure, error) {
+	cfg := currentConfig()
+	rows, err := db.Query(`
+    WITH Failing AS (
+        SELECT f.*,
+            ROW_NUMBER() OVER (PARTITION BY url, COALESCE(ip, '') ORDER BY checked_at DESC, id DESC) as rn,
+            COUNT(*) OVER (PARTITION BY url, COALESCE(ip, '')) as failures,
+            MIN(checked_at) OVER (PARTITION BY url, COALESCE(ip, '')) as failing_since
+        FROM check_failures f
+        WHERE checked_at > COALESCE((` + lastSuccessQuery + `), '')
+    )
+    SELECT id, url, COALESCE(ip, ''), checked_at, error_class, error, failures, failing_since
+    FROM Failing
+    WHERE rn = 1
+        AND checked_at >= COALESCE((SELECT MAX(c.checked_at) FROM cert_checks c WHERE c.url = Failing.url), '')
+        AND checked_at = (SELECT MAX(g.checked_at) FROM check_failures g WHERE g.url = Failing.url)
+    ORDER BY url, COALESCE(ip, '')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []*TargetFailure
+	for rows.Next() {
+		var f TargetFailure
+		var checkedAtStr, failingSinceStr string
+		err := rows.Scan(&f.ID, &f.URL, &f.IP, &checkedAtStr, &f.ErrorClass, &f.Error, &f.Failures, &failingSinceStr)
+		if err != nil {
+			return nil, err
+		}
+		if !cfg.hasTarget(f.URL) {
+			continue
+		}
+		f.CheckedAt, _ = time.Parse(time.RFC3339, checkedAtStr)
+		f.FailingSince, _ = time.Parse(time.RFC3339, failingSinceStr)
+		failures = append(failures, &f)
+	}
+	return failures, rows.Err()
+}
+
+// withFailures attaches current failures to the certificates of the
+// failing targets, and those of single addresses to the certificates
+// checked at that address. Configured targets and addresses that failed
+// without a certificate among certs are added as entries carrying only the
+// failure, first.
+func withFailures(certs []CertInfo, failures []*TargetFailure) []CertInfo {
+	byURL := make(map[string][]*TargetFailure)
+	byAddress := make(map[string]*TargetFailure)
+	for _, f := range failures {
+		byURL[f.URL] = append(byURL[f.URL], f)
+		byAddress[addressKey(f.URL, f.IP)] = f
+	}
+
+	seen := make(map[string]bool)
+	for i := range certs {
+		f := byAddress[addressKey(certs[i].URL, "")]
+		if f == nil && certs[i].IP != "" {
+			f = byAddress[addressKey(certs[i].URL, certs[i].IP)]
+		}
+		certs[i].Failure = f
+		seen[addressKey(certs[i].URL, "")] = true
+		seen[addressKey(certs[i].URL, certs[i].IP)] = true
+	}
+
+	var failed []CertInfo
+	for _, target := range currentConfig().URLs {
+		for _, f := range byURL[target.URL] {
+			if seen[addressKey(f.URL, f.IP)] {
+				continue
+			}
+			failed = append(failed, CertInfo{
+				URL:            target.URL,
+				Host:           target.Host,
+				Port:           target.Port,
+				Protocol:       target.Protocol,
+				IP:             f.IP,
+				Labels:         target.Labels,
+				DiscoveredFrom: target.DiscoveredFrom,
+				Failure:        f,
+			})
+		}
+	}
+	return append(failed, certs...)
+}
+
+func addressKey(url, ip string) string {
+	return url + "\x00" + ip
+}
+
+// Outage is a run of consecutive failed checks of a target, or of one of
+// its addresses.
+type Outage struct {
+	URL        string
+	IP         string
+	Start      time.Time // first failed check
+	End        time.Time // last failed check
+	Failures   int
+	ErrorClass string // of the first failed check
+	Error      string
+}
+
+// loadOutages groups the failed checks of url (or of every target when url
+// is empty) between from and to into outages, oldest first. Failures
+// belong to the same outage when no successful check lies between them;
+// those of an address only end with a success of that address.
+func loadOutages(url string, from, to time.Time) ([]Outage, error) {
+	// SQLite takes the bare error_class and error columns from the row
+	// holding MIN(checked_at).
+	query := `
+    WITH Failures AS (
+        SELECT f.*,
+            COALESCE((
+                SELECT MAX(c.checked_at) FROM cert_checks c
+                WHERE c.url = f.url AND (COALESCE(f.ip, '') = '' OR c.ip = f.ip)
+                    AND c.checked_at < f.checked_at
+            ), '') as last_success
+        FROM check_failures f
+        WHERE checked_at >= ? AND checked_at <= ?`
+	args := []interface{}{from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339)}
+	if url != "" {
+		query += " AND url = ?"
+		args = append(args, url)
+	}
+	query += `
+    )
+    SELECT url, COALESCE(ip, ''), MIN(checked_at), MAX(checked_at), COUNT(*), error_class, COALESCE(error, '')
+    FROM Failures
+    GROUP BY url, COALESCE(ip, ''), last_success
+    ORDER BY MIN(checked_at)`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outages []Outage
+	for rows.Next() {
+		var o Outage
+		var startStr, endStr string
+		if err := rows.Scan(&o.URL, &o.IP, &startStr, &endStr, &o.Failures, &o.ErrorClass, &o.Error); err != nil {
+			return nil, err
+		}
+		o.Start, _ = time.Parse(time.RFC3339, startStr)
+		o.End, _ = time.Parse(time.RFC3339, endStr)
+		outages = append(outages, o)
+	}
+	return outages, rows.Err()
+}
+
+func outageAnnotation(o Outage) Annotation {
+	text := fmt.Sprintf("%d failed checks: %s", o.Failures, o.Error)
+	if o.Failures == 1 {
+		text = o.Error
+	}
+
+	subject := o.URL
+	if o.IP != "" {
+		subject = fmt.Sprintf("%s (%s)", o.URL, o.IP)
+	}
+
+	a := Annotation{
+		Time:  o.Start.UnixMilli(),
+		Title: fmt.Sprintf("Check failed (%s): %s", o.ErrorClass, subject),
+		Text:  text,
+		Tags:  []string{"failure", o.ErrorClass, o.URL},
+	}
+	if o.End.After(o.Start) {
+		a.TimeEnd = o.End.UnixMilli()
+	}
+	return a
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	keystore "github.com/pavlo-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ProtocolFile marks targets that read certificates from disk instead of
+// connecting to an endpoint. They are written as file:// URLs whose path
+// may be a file, a directory (scanned recursively) or a glob pattern.
+const ProtocolFile = "file"
+
+const filePrefix = "file://"
+
+// jksMagic starts every Java KeyStore file.
+var jksMagic = []byte{0xfe, 0xed, 0xfe, 0xed}
+
+// getFileCertInfos reads every certificate found under target.Path.
+func getFileCertInfos(target Target) ([]*CertInfo, error) {
+	paths, err := expandPath(target.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var infos []*CertInfo
+	for _, path := range paths {
+		certs, err := readCertFile(path, target.Password)
+		if err != nil {
+			log.Printf("Error reading certificates from %s: %v", path, err)
+			continue
+		}
+
+		for i, cert := range certs {
+			info := newCertInfo(cert, now)
+			info.URL = target.URL
+			info.Protocol = ProtocolFile
+			info.SourcePath = path
+			info.SourceIndex = i
+			infos = append(infos, info)
+		}
+	}
+
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("%w found in %s", errNoCertificate, target.Path)
+	}
+	return infos, nil
+}
+
+// expandPath resolves a glob pattern to the regular files it names,
+// descending into any directories it matches. Symlinks to regular files
+// are included, as in Let's Encrypt live directories and /etc/ssl/certs;
+// symlinked directories are not followed.
+func expandPath(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match %s", pattern)
+	}
+
+	var paths []string
+	for _, match := range matches {
+		err := filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// The timestamped copies behind the ..data symlink of
+			// Kubernetes ConfigMap and Secret volumes
+			if d.IsDir() && path != match && strings.HasPrefix(d.Name(), "..") {
+				return filepath.SkipDir
+			}
+			switch {
+			case d.Type().IsRegular():
+				paths = append(paths, path)
+			case d.Type()&fs.ModeSymlink != 0:
+				if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+					paths = append(paths, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// readCertFile parses the certificates in a PEM bundle, DER file, PKCS#12
+// archive or Java KeyStore. Files holding no certificates, such as private
+// keys, yield an empty list.
+func readCertFile(path, password string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, jksMagic):
+		return parseJKS(data, password)
+	case bytes.Contains(data, []byte("-----BEGIN")):
+		return parsePEM(data)
+	}
+
+	if certs, err := x509.ParseCertificates(data); err == nil {
+		return certs, nil
+	}
+
+	// PKCS#12 is DER as well, so it's only tried once the data turned out
+	// not to be plain certificates.
+	certs, err := parsePKCS12(data, password)
+	if err != nil {
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".p12" || ext == ".pfx" {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return certs, nil
+}
+
+func parsePEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func parsePKCS12(data []byte, password string) ([]*x509.Certificate, error) {
+	_, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err == nil {
+		return append([]*x509.Certificate{cert}, caCerts...), nil
+	}
+
+	// Archives without a private key are trust stores
+	certs, trustErr := pkcs12.DecodeTrustStore(data, password)
+	if trustErr != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func parseJKS(data []byte, password string) ([]*x509.Certificate, error) {
+	ks := keystore.New(keystore.WithOrderedAliases())
+	if err := ks.Load(bytes.NewReader(data), []byte(password)); err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	add := func(c keystore.Certificate) error {
+		cert, err := x509.ParseCertificate(c.Content)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		return nil
+	}
+
+	for _, alias := range ks.Aliases() {
+		switch {
+		case ks.IsPrivateKeyEntry(alias):
+			chain, err := ks.GetPrivateKeyEntryCertificateChain(alias)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range chain {
+				if err := add(c); err != nil {
+					return nil, err
+				}
+			}
+		case ks.IsTrustedCertificateEntry(alias):
+			entry, err := ks.GetTrustedCertificateEntry(alias)
+			if err != nil {
+				return nil, err
+			}
+			if err := add(entry.Certificate); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return certs, nil
+}
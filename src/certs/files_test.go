@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExpandPathSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("cert"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustLink := func(target, link string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Let's Encrypt: live/<name>/*.pem link to archive/<name>/*1.pem
+	mustWrite(filepath.Join(dir, "le/archive/example.com/fullchain1.pem"))
+	mustLink("../../archive/example.com/fullchain1.pem", filepath.Join(dir, "le/live/example.com/fullchain.pem"))
+
+	// Kubernetes volume: tls.crt -> ..data/tls.crt, ..data -> ..2024_01_01
+	mustWrite(filepath.Join(dir, "k8s/..2024_01_01/tls.crt"))
+	mustLink("..2024_01_01", filepath.Join(dir, "k8s/..data"))
+	mustLink("..data/tls.crt", filepath.Join(dir, "k8s/tls.crt"))
+
+	// Dangling links are skipped
+	mustLink("missing.pem", filepath.Join(dir, "dangling/missing.pem"))
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"le/live/example.com/fullchain.pem", []string{"le/live/example.com/fullchain.pem"}},
+		{"le/live", []string{"le/live/example.com/fullchain.pem"}},
+		{"le/live/*/fullchain.pem", []string{"le/live/example.com/fullchain.pem"}},
+		{"k8s", []string{"k8s/tls.crt"}},
+		{"dangling", nil},
+	}
+	for _, tt := range tests {
+		got, err := expandPath(filepath.Join(dir, tt.pattern))
+		if err != nil {
+			t.Errorf("expandPath(%q): %v", tt.pattern, err)
+			continue
+		}
+		var want []string
+		for _, w := range tt.want {
+			want = append(want, filepath.Join(dir, w))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("expandPath(%q) = %q, want %q", tt.pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProtocolKubernetes marks targets that read Kubernetes manifests exported
+// to disk, such as `kubectl get secrets -A -o yaml` dumps or a GitOps
+// checkout. They are written as k8s:// URLs whose path may be a file,
+// a directory or a glob, like file targets.
+const ProtocolKubernetes = "kubernetes"
+
+const kubePrefix = "k8s://"
+
+// Keys of kubernetes.io/tls Secrets that hold certificates.
+var kubeSecretCertKeys = []string{"tls.crt", "ca.crt"}
+
+// kubeObject holds the fields of Secrets and cert-manager Certificates the
+// checker needs, and of the Ingresses and Gateways targets are discovered
+// from (see discovery.go). Lists, as written by kubectl, carry their
+// objects in Items.
+type kubeObject struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+	StringData map[string]string `yaml:"stringData"`
+	Spec       struct {
+		CommonName string   `yaml:"commonName"`
+		DNSNames   []string `yaml:"dnsNames"`
+		IssuerRef  struct {
+			Name string `yaml:"name"`
+		} `yaml:"issuerRef"`
+		TLS []struct {
+			Hosts []string `yaml:"hosts"`
+		} `yaml:"tls"`
+		Listeners []struct {
+			Hostname string `yaml:"hostname"`
+			Port     int    `yaml:"port"`
+			Protocol string `yaml:"protocol"`
+		} `yaml:"listeners"`
+	} `yaml:"spec"`
+	Status struct {
+		NotBefore string `yaml:"notBefore"`
+		NotAfter  string `yaml:"notAfter"`
+	} `yaml:"status"`
+	Items []kubeObject `yaml:"items"`
+}
+
+// getKubeCertInfos reads every TLS Secret and cert-manager Certificate
+// found in the manifests under target.Path.
+func getKubeCertInfos(target Target) ([]*CertInfo, error) {
+	paths, err := expandPath(target.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var infos []*CertInfo
+	for _, path := range paths {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+
+		objects, err := readManifests(path)
+		if err != nil {
+			log.Printf("Error reading manifests from %s: %v", path, err)
+			continue
+		}
+
+		for _, obj := range objects {
+			for _, info := range kubeCertInfos(obj, now) {
+				info.URL = target.URL
+				info.SourcePath = path
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("%w found in %s (no TLS secrets or cert-manager Certificates)", errNoCertificate, target.Path)
+	}
+	return infos, nil
+}
+
+// readManifests decodes every YAML or JSON document in path, flattening
+// List objects into their items.
+func readManifests(path string) ([]kubeObject, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []kubeObject
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var obj kubeObject
+		err := dec.Decode(&obj)
+		if err == io.EOF {
+			break
+		}
+		// Other kinds may use the same field names with different types
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(obj.Items) > 0 {
+			objects = append(objects, obj.Items...)
+		} else {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+// kubeCertInfos returns the certificates carried by a Secret, or the
+// expiry reported in a cert-manager Certificate's status.
+func kubeCertInfos(obj kubeObject, now time.Time) []*CertInfo {
+	switch {
+	case obj.Kind == "Secret":
+		return kubeSecretCertInfos(obj, now)
+	case obj.Kind == "Certificate" && strings.HasPrefix(obj.APIVersion, "cert-manager.io/"):
+		info, err := certManagerCertInfo(obj, now)
+		if err != nil {
+			log.Printf("Error reading Certificate %s/%s: %v", obj.Metadata.Namespace, obj.Metadata.Name, err)
+			return nil
+		}
+		return []*CertInfo{info}
+	}
+	return nil
+}
+
+func kubeSecretCertInfos(obj kubeObject, now time.Time) []*CertInfo {
+	var infos []*CertInfo
+	for _, key := range kubeSecretCertKeys {
+		pemData, err := secretValue(obj, key)
+		if err != nil {
+			log.Printf("Error decoding %s of Secret %s/%s: %v", key, obj.Metadata.Namespace, obj.Metadata.Name, err)
+			continue
+		}
+		if pemData == nil {
+			continue
+		}
+
+		certs, err := parsePEM(pemData)
+		if err != nil {
+			log.Printf("Error parsing %s of Secret %s/%s: %v", key, obj.Metadata.Namespace, obj.Metadata.Name, err)
+			continue
+		}
+
+		for i, cert := range certs {
+			info := newCertInfo(cert, now)
+			info.Protocol = ProtocolKubernetes
+			info.SourceIndex = i
+			info.Namespace = obj.Metadata.Namespace
+			info.Name = obj.Metadata.Name
+			info.Kind = obj.Kind
+			info.SecretKey = key
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// secretValue returns the decoded value of key, preferring stringData as
+// the API server does. It returns nil if the Secret has no such key.
+func secretValue(obj kubeObject, key string) ([]byte, error) {
+	if v, ok := obj.StringData[key]; ok {
+		return []byte(v), nil
+	}
+	if v, ok := obj.Data[key]; ok && v != "" {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return nil, nil
+}
+
+func certManagerCertInfo(obj kubeObject, now time.Time) (*CertInfo, error) {
+	if obj.Status.NotAfter == "" {
+		return nil, fmt.Errorf("status has no notAfter, certificate not issued yet")
+	}
+	notAfter, err := time.Parse(time.RFC3339, obj.Status.NotAfter)
+	if err != nil {
+		return nil, err
+	}
+	notBefore, _ := time.Parse(time.RFC3339, obj.Status.NotBefore)
+
+	issuedTo := obj.Spec.CommonName
+	if issuedTo == "" && len(obj.Spec.DNSNames) > 0 {
+		issuedTo = obj.Spec.DNSNames[0]
+	}
+
+	return &CertInfo{
+		Protocol:      ProtocolKubernetes,
+		Namespace:     obj.Metadata.Namespace,
+		Name:          obj.Metadata.Name,
+		Kind:          obj.Kind,
+		IssuedTo:      issuedTo,
+		IssuedBy:      obj.Spec.IssuerRef.Name,
+		DNSNames:      obj.Spec.DNSNames,
+		ValidFrom:     notBefore,
+		ValidUntil:    notAfter,
+		DaysRemaining: daysUntil(notAfter, now),
+		CheckedAt:     now,
+		ChainValid:    true,
+	}, nil
+}
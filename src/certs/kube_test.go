@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedPEM returns a PEM encoded self-signed certificate for cn.
+func selfSignedPEM(t *testing.T, cn string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 3, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// tlsSecret returns a Secret manifest carrying certPEM as tls.crt.
+func tlsSecret(namespace, name, certPEM string) string {
+	indented := "    " + strings.ReplaceAll(strings.TrimSpace(certPEM), "\n", "\n    ")
+	return fmt.Sprintf(`apiVersion: v1
+kind: Secret
+type: kubernetes.io/tls
+metadata:
+  namespace: %s
+  name: %s
+stringData:
+  tls.crt: |
+%s
+`, namespace, name, indented)
+}
+
+func TestKubeCertIdentity(t *testing.T) {
+	dir := t.TempDir()
+	target := Target{URL: "k8s://" + dir}
+	if err := target.parse(); err != nil {
+		t.Fatal(err)
+	}
+	useTestDB(t, Config{URLs: []Target{target}})
+
+	web := tlsSecret("prod", "web", selfSignedPEM(t, "web.example.com"))
+	api := tlsSecret("prod", "api", selfSignedPEM(t, "api.example.com"))
+
+	check := func(manifests ...string) []*CertInfo {
+		t.Helper()
+		data := strings.Join(manifests, "---\n")
+		if err := os.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		infos, err := getKubeCertInfos(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if rot, err := detectRotation(info); err != nil {
+				t.Fatal(err)
+			} else if rot != nil {
+				t.Errorf("%s reported as rotated", certSubject(info))
+			}
+			if err := storeCertInfo(info); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return infos
+	}
+
+	first := check(web)
+
+	// Another Secret ahead of web in the same manifest
+	second := check(api, web)
+	if len(second) != 2 || slotKey(*second[1]) != slotKey(*first[0]) {
+		t.Errorf("web moved from %q to %q", slotKey(*first[0]), slotKey(*second[1]))
+	}
+	if second[0].SourceIndex != 0 || second[1].SourceIndex != 0 {
+		t.Errorf("source indexes = %d, %d, want positions within tls.crt", second[0].SourceIndex, second[1].SourceIndex)
+	}
+
+	// web deleted from the manifest
+	time.Sleep(time.Second) // checks are stored with second precision
+	check(api)
+	certs, err := latestCerts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range certs {
+		names = append(names, info.Name)
+	}
+	if !slices.Equal(names, []string{"api"}) {
+		t.Errorf("latestCerts returned %q, want [api]", names)
+	}
+}
@@ -2,209 +2,422 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type Config struct {
-	URLs []string `json:"urls"`
+type CertInfo struct {
+	ID          int64  `json:"-"`
+	URL         string `json:"url"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	IP          string `json:"ip,omitempty"` // address checked, for targets with all_addresses
+	Protocol    string `json:"protocol"`
+	SourcePath  string `json:"source_path,omitempty"` // file the certificate was read from
+	SourceIndex int    `json:"source_index"`          // position of the certificate within SourcePath, or within SecretKey
+	Namespace   string `json:"namespace,omitempty"`   // Kubernetes object the certificate came from
+	Name        string `json:"name,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	SecretKey   string `json:"secret_key,omitempty"` // tls.crt or ca.crt for Secrets
+	IssuedTo    string `json:"issued_to"`
+	IssuedBy    string `json:"issued_by"`
+
+	DNSNames           []string `json:"dns_names"`
+	IPAddresses        []string `json:"ip_addresses"`
+	SerialNumber       string   `json:"serial_number"` // hex
+	FingerprintSHA256  string   `json:"fingerprint_sha256"`
+	KeyAlgorithm       string   `json:"key_algorithm"`
+	KeySize            int      `json:"key_size"` // bits
+	SignatureAlgorithm string   `json:"signature_algorithm"`
+	IsCA               bool     `json:"is_ca"`
+
+	ValidFrom     time.Time   `json:"valid_from"`
+	ValidUntil    time.Time   `json:"valid_until"`
+	DaysRemaining int         `json:"days_remaining"`
+	CheckedAt     time.Time   `json:"checked_at"`
+	ChainValid    bool        `json:"chain_valid"`
+	ChainError    string      `json:"chain_error,omitempty"`
+	Chain         []ChainCert `json:"chain,omitempty"`
+
+	// HostnameMatch tells whether the certificate covers the requested
+	// hostname. It is only set for network targets.
+	HostnameMatch *bool  `json:"hostname_match,omitempty"`
+	HostnameError string `json:"hostname_error,omitempty"`
+
+	// ClientIdentity is the subject of the client certificate presented
+	// for mutual TLS, if any.
+	ClientIdentity string `json:"client_identity,omitempty"`
+
+	// Labels are those of the target when it was checked.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// DiscoveredFrom is taken from the target when reporting; it is not
+	// stored with the check.
+	DiscoveredFrom string `json:"discovered_from,omitempty"`
+
+	RevocationStatus string     `json:"revocation_status,omitempty"` // good, revoked or unknown; see revocation.go
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+	RevocationSource string     `json:"revocation_source,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+
+	// Failure is set when checks of the target have been failing since
+	// this certificate was seen. It is not stored with the check.
+	Failure *TargetFailure `json:"failure,omitempty"`
 }
 
-type CertInfo struct {
-	URL           string    `json:"url"`
+// fromNetwork reports whether the certificate was read from an endpoint,
+// as opposed to a file or manifest on disk.
+func (info CertInfo) fromNetwork() bool {
+	return info.Protocol != ProtocolFile && info.Protocol != ProtocolKubernetes
+}
+
+// ChainCert is an intermediate certificate sent by the server along with
+// the leaf. Position 1 is the certificate that signed the leaf.
+type ChainCert struct {
+	Position      int       `json:"position"`
 	IssuedTo      string    `json:"issued_to"`
 	IssuedBy      string    `json:"issued_by"`
 	ValidFrom     time.Time `json:"valid_from"`
 	ValidUntil    time.Time `json:"valid_until"`
 	DaysRemaining int       `json:"days_remaining"`
-	CheckedAt     time.Time `json:"checked_at"`
 }
 
 var db *sql.DB
 
-func init() {
+// openDB opens certs.db and brings its schema up to date. Only the
+// service uses the database; `certs check` runs without it.
+func openDB() {
 	var err error
 	db, err = sql.Open("sqlite3", "./certs.db")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Create table if not exists
-	createTable := `
-    CREATE TABLE IF NOT EXISTS cert_checks (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        url TEXT,
-        issued_to TEXT,
-        issued_by TEXT,
-        valid_from DATETIME,
-        valid_until DATETIME,
-        days_remaining INTEGER,
-        checked_at DATETIME
-    );`
-
-	_, err = db.Exec(createTable)
-	if err != nil {
+	if err := migrate(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func loadConfig() Config {
-	f, err := os.ReadFile("./config.json")
+func getCertInfo(target Target) (*CertInfo, error) {
+	roots, err := loadRoots(target.CABundle)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	var cfg Config
-	err = json.Unmarshal(f, &cfg)
+	// Verification is done by hand below so that a broken chain is still
+	// recorded instead of failing the whole check.
+	cfg, identity, err := target.clientTLSConfig()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return cfg
-}
-
-func getCertInfo(url string) (*CertInfo, error) {
-	conn, err := tls.Dial("tcp", url+":443", &tls.Config{
-		InsecureSkipVerify: true,
-	})
+	cfg.MinVersion = target.MinVersion
+	conn, err := dialTarget(target, cfg)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
-	cert := conn.ConnectionState().PeerCertificates[0]
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w presented by %s", errNoCertificate, target.URL)
+	}
+
+	cert := certs[0]
 	now := time.Now()
-	daysRemaining := int(cert.NotAfter.Sub(now).Hours() / 24)
+
+	info := newCertInfo(cert, now)
+	info.URL = target.URL
+	info.Host = target.Host
+	info.Port = target.Port
+	info.IP = target.IP
+	info.ClientIdentity = identity
+	info.Protocol = target.Protocol
+
+	chains, err := verifyChain(certs, roots, now)
+	if err != nil {
+		info.ChainValid = false
+		info.ChainError = err.Error()
+	}
+
+	// VerifyHostname applies the SAN and wildcard matching rules of RFC 6125
+	hostnameMatch := true
+	if err := cert.VerifyHostname(target.serverName()); err != nil {
+		hostnameMatch = false
+		info.HostnameError = err.Error()
+	}
+	info.HostnameMatch = &hostnameMatch
+
+	revocation := checkRevocation(cert, findIssuer(certs, chains), conn.ConnectionState().OCSPResponse, target.OCSPURL)
+	info.RevocationStatus = revocation.Status
+	info.RevocationReason = revocation.Reason
+	info.RevocationSource = revocation.Source
+	if !revocation.RevokedAt.IsZero() {
+		info.RevokedAt = &revocation.RevokedAt
+	}
+
+	for i, c := range certs[1:] {
+		info.Chain = append(info.Chain, ChainCert{
+			Position:      i + 1,
+			IssuedTo:      c.Subject.CommonName,
+			IssuedBy:      c.Issuer.CommonName,
+			ValidFrom:     c.NotBefore,
+			ValidUntil:    c.NotAfter,
+			DaysRemaining: daysUntil(c.NotAfter, now),
+		})
+	}
+
+	return info, nil
+}
+
+// newCertInfo describes cert as seen at now. Callers fill in where the
+// certificate came from.
+func newCertInfo(cert *x509.Certificate, now time.Time) *CertInfo {
+	var ips []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
 
 	return &CertInfo{
-		URL:           url,
-		IssuedTo:      cert.Subject.CommonName,
-		IssuedBy:      cert.Issuer.CommonName,
-		ValidFrom:     cert.NotBefore,
-		ValidUntil:    cert.NotAfter,
-		DaysRemaining: daysRemaining,
-		CheckedAt:     now,
-	}, nil
+		IssuedTo:           cert.Subject.CommonName,
+		IssuedBy:           cert.Issuer.CommonName,
+		DNSNames:           cert.DNSNames,
+		IPAddresses:        ips,
+		SerialNumber:       hex.EncodeToString(cert.SerialNumber.Bytes()),
+		FingerprintSHA256:  hex.EncodeToString(fingerprint[:]),
+		KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+		KeySize:            publicKeySize(cert.PublicKey),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		IsCA:               cert.IsCA,
+		ValidFrom:          cert.NotBefore,
+		ValidUntil:         cert.NotAfter,
+		DaysRemaining:      daysUntil(cert.NotAfter, now),
+		CheckedAt:          now,
+		ChainValid:         true,
+	}
+}
+
+// publicKeySize returns the size of key in bits, or 0 for unknown key types.
+func publicKeySize(key interface{}) int {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	}
+	return 0
+}
+
+func daysUntil(t, now time.Time) int {
+	return int(t.Sub(now).Hours() / 24)
+}
+
+// loadRoots returns the system root pool, extended with the certificates
+// from caBundle when one is configured.
+func loadRoots(caBundle string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf("Error loading system roots, using an empty pool: %v", err)
+		roots = x509.NewCertPool()
+	}
+
+	if caBundle == "" {
+		return roots, nil
+	}
+
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caBundle)
+	}
+	return roots, nil
+}
+
+// verifyChain checks that the leaf chains up to one of roots using the
+// intermediates presented alongside it.
+// It returns the verified chains, leaf first.
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool, now time.Time) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	return certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+}
+
+// findIssuer returns the certificate that issued the leaf, taken from the
+// verified chain or, if the chain didn't verify, from the certificates the
+// server sent.
+func findIssuer(certs []*x509.Certificate, chains [][]*x509.Certificate) *x509.Certificate {
+	if len(chains) > 0 && len(chains[0]) > 1 {
+		return chains[0][1]
+	}
+	for _, c := range certs[1:] {
+		if bytes.Equal(c.RawSubject, certs[0].RawIssuer) {
+			return c
+		}
+	}
+	return nil
 }
 
 func storeCertInfo(info *CertInfo) error {
 	query := `
     INSERT INTO cert_checks (
-        url, issued_to, issued_by, valid_from, valid_until, days_remaining, checked_at
-    ) VALUES (?, ?, ?, ?, ?, ?, ?)`
+        url, host, port, protocol, source_path, source_index, namespace, name, kind, secret_key,
+        issued_to, issued_by, dns_names, ip_addresses, serial_number, fingerprint_sha256,
+        key_algorithm, key_size, signature_algorithm, is_ca,
+        valid_from, valid_until, days_remaining, checked_at,
+        chain_valid, chain_error, revocation_status, revocation_reason, revocation_source, revoked_at,
+        hostname_match, hostname_error, ip, client_identity, labels
+    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	var revokedAt interface{}
+	if info.RevokedAt != nil {
+		revokedAt = info.RevokedAt.UTC().Format(time.RFC3339)
+	}
+
+	var labels interface{}
+	if len(info.Labels) > 0 {
+		data, err := json.Marshal(info.Labels)
+		if err != nil {
+			return err
+		}
+		labels = string(data)
+	}
 
-	_, err := db.Exec(query,
+	res, err := db.Exec(query,
 		info.URL,
+		info.Host,
+		info.Port,
+		info.Protocol,
+		info.SourcePath,
+		info.SourceIndex,
+		info.Namespace,
+		info.Name,
+		info.Kind,
+		info.SecretKey,
 		info.IssuedTo,
 		info.IssuedBy,
-		info.ValidFrom.Format(time.RFC3339),
-		info.ValidUntil.Format(time.RFC3339),
+		strings.Join(info.DNSNames, ","),
+		strings.Join(info.IPAddresses, ","),
+		info.SerialNumber,
+		info.FingerprintSHA256,
+		info.KeyAlgorithm,
+		info.KeySize,
+		info.SignatureAlgorithm,
+		info.IsCA,
+		info.ValidFrom.UTC().Format(time.RFC3339),
+		info.ValidUntil.UTC().Format(time.RFC3339),
 		info.DaysRemaining,
-		info.CheckedAt.Format(time.RFC3339),
+		info.CheckedAt.UTC().Format(time.RFC3339),
+		info.ChainValid,
+		info.ChainError,
+		info.RevocationStatus,
+		info.RevocationReason,
+		info.RevocationSource,
+		revokedAt,
+		info.HostnameMatch,
+		info.HostnameError,
+		info.IP,
+		info.ClientIdentity,
+		labels,
 	)
-	return err
-}
-
-func handleMetrics(w http.ResponseWriter, r *http.Request) {
-	// Query to get latest cert info for each URL
-	query := `
-    WITH RankedCerts AS (
-        SELECT *,
-            ROW_NUMBER() OVER (PARTITION BY url ORDER BY checked_at DESC) as rn
-        FROM cert_checks
-    )
-    SELECT url, issued_to, issued_by, valid_from, valid_until, days_remaining, checked_at
-    FROM RankedCerts
-    WHERE rn = 1`
-
-	rows, err := db.Query(query)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer rows.Close()
 
-	var metrics []string
-	for rows.Next() {
-		var info CertInfo
-		var validFromStr, validUntilStr, checkedAtStr string
+	info.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
 
-		err := rows.Scan(
-			&info.URL,
-			&info.IssuedTo,
-			&info.IssuedBy,
-			&validFromStr,
-			&validUntilStr,
-			&info.DaysRemaining,
-			&checkedAtStr,
+	for _, c := range info.Chain {
+		_, err := db.Exec(`
+        INSERT INTO cert_chain (
+            check_id, position, issued_to, issued_by, valid_from, valid_until, days_remaining
+        ) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			info.ID,
+			c.Position,
+			c.IssuedTo,
+			c.IssuedBy,
+			c.ValidFrom.UTC().Format(time.RFC3339),
+			c.ValidUntil.UTC().Format(time.RFC3339),
+			c.DaysRemaining,
 		)
 		if err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
+			return err
 		}
-
-		// Main metric for days remaining
-		metrics = append(metrics, fmt.Sprintf(
-			"ssl_cert_days_remaining{url=\"%s\",issued_to=\"%s\",issuer=\"%s\"} %d",
-			info.URL,
-			info.IssuedTo,
-			info.IssuedBy,
-			info.DaysRemaining,
-		))
-
-		// Add a metric for certificate validity (1 = valid, 0 = expired)
-		isValid := 0
-		if info.DaysRemaining > 0 {
-			isValid = 1
-		}
-		metrics = append(metrics, fmt.Sprintf(
-			"ssl_cert_valid{url=\"%s\",issued_to=\"%s\",issuer=\"%s\"} %d",
-			info.URL,
-			info.IssuedTo,
-			info.IssuedBy,
-			isValid,
-		))
-
-		// Add expiry timestamp as unix timestamp
-		validUntil, _ := time.Parse(time.RFC3339, validUntilStr)
-		metrics = append(metrics, fmt.Sprintf(
-			"ssl_cert_expiry_timestamp{url=\"%s\",issued_to=\"%s\",issuer=\"%s\"} %d",
-			info.URL,
-			info.IssuedTo,
-			info.IssuedBy,
-			validUntil.Unix(),
-		))
-	}
-
-	w.Header().Set("Content-Type", "text/plain")
-	for _, m := range metrics {
-		fmt.Fprintln(w, m)
 	}
+	return nil
 }
 
-func handleSimpleCerts(w http.ResponseWriter, r *http.Request) {
+// latestCerts returns the most recent check for each configured URL (and,
+// for file targets, each certificate found in their latest check) together
+// with the intermediates recorded for it.
+func latestCerts(orderBy string) ([]CertInfo, error) {
+	cfg := currentConfig()
 	query := `
     WITH RankedCerts AS (
         SELECT *,
-            ROW_NUMBER() OVER (PARTITION BY url ORDER BY checked_at DESC) as rn
+            ROW_NUMBER() OVER (
+                PARTITION BY url, COALESCE(source_path, ''), COALESCE(source_index, 0), COALESCE(ip, ''),
+                    COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, '')
+                ORDER BY checked_at DESC
+            ) as rn,
+            MAX(checked_at) OVER (PARTITION BY url) as last_checked
         FROM cert_checks
     )
-    SELECT url, issued_to, issued_by, valid_from, valid_until, days_remaining, checked_at
+    SELECT id, url, COALESCE(host, url), COALESCE(port, 443), COALESCE(protocol, 'tls'),
+        COALESCE(source_path, ''), COALESCE(source_index, 0),
+        COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, ''),
+        issued_to, issued_by,
+        COALESCE(dns_names, ''), COALESCE(ip_addresses, ''), COALESCE(serial_number, ''),
+        COALESCE(fingerprint_sha256, ''), COALESCE(key_algorithm, ''), COALESCE(key_size, 0),
+        COALESCE(signature_algorithm, ''), COALESCE(is_ca, 0),
+        valid_from, valid_until, days_remaining, checked_at,
+        COALESCE(chain_valid, 1), COALESCE(chain_error, ''),
+        COALESCE(revocation_status, ''), COALESCE(revocation_reason, ''), COALESCE(revocation_source, ''),
+        revoked_at, hostname_match, COALESCE(hostname_error, ''), COALESCE(ip, ''),
+        COALESCE(client_identity, ''), COALESCE(labels, '')
     FROM RankedCerts
     WHERE rn = 1
-    ORDER BY days_remaining ASC` // Ordering by days_remaining to show most urgent first
+        -- addresses a hostname no longer resolves to, and certificates no
+        -- longer found on disk or in the manifests, drop out
+        AND ((COALESCE(ip, '') = '' AND COALESCE(source_path, '') = '') OR checked_at = last_checked)`
+	if orderBy != "" {
+		query += "\n    ORDER BY " + orderBy
+	}
 
 	rows, err := db.Query(query)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -212,28 +425,149 @@ func handleSimpleCerts(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var info CertInfo
 		var validFromStr, validUntilStr, checkedAtStr string
+		var revokedAtStr sql.NullString
+		var hostnameMatch sql.NullBool
+		var dnsNames, ipAddresses, labels string
 
 		err := rows.Scan(
+			&info.ID,
 			&info.URL,
+			&info.Host,
+			&info.Port,
+			&info.Protocol,
+			&info.SourcePath,
+			&info.SourceIndex,
+			&info.Namespace,
+			&info.Name,
+			&info.Kind,
+			&info.SecretKey,
 			&info.IssuedTo,
 			&info.IssuedBy,
+			&dnsNames,
+			&ipAddresses,
+			&info.SerialNumber,
+			&info.FingerprintSHA256,
+			&info.KeyAlgorithm,
+			&info.KeySize,
+			&info.SignatureAlgorithm,
+			&info.IsCA,
 			&validFromStr,
 			&validUntilStr,
 			&info.DaysRemaining,
 			&checkedAtStr,
+			&info.ChainValid,
+			&info.ChainError,
+			&info.RevocationStatus,
+			&info.RevocationReason,
+			&info.RevocationSource,
+			&revokedAtStr,
+			&hostnameMatch,
+			&info.HostnameError,
+			&info.IP,
+			&info.ClientIdentity,
+			&labels,
 		)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 
 		// Parse the time strings
 		info.ValidFrom, _ = time.Parse(time.RFC3339, validFromStr)
 		info.ValidUntil, _ = time.Parse(time.RFC3339, validUntilStr)
 		info.CheckedAt, _ = time.Parse(time.RFC3339, checkedAtStr)
+		info.DNSNames = splitList(dnsNames)
+		info.IPAddresses = splitList(ipAddresses)
+		if hostnameMatch.Valid {
+			info.HostnameMatch = &hostnameMatch.Bool
+		}
+		if revokedAtStr.Valid {
+			if revokedAt, err := time.Parse(time.RFC3339, revokedAtStr.String); err == nil {
+				info.RevokedAt = &revokedAt
+			}
+		}
+		if labels != "" {
+			if err := json.Unmarshal([]byte(labels), &info.Labels); err != nil {
+				return nil, fmt.Errorf("labels of check %d: %v", info.ID, err)
+			}
+		}
 
+		target, ok := cfg.findTarget(info.URL)
+		if !ok {
+			continue
+		}
+		info.DiscoveredFrom = target.DiscoveredFrom
 		results = append(results, info)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Chain, err = loadChain(results[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// splitList reverses strings.Join(list, ",") as used for list columns.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func loadChain(checkID int64) ([]ChainCert, error) {
+	rows, err := db.Query(`
+    SELECT position, issued_to, issued_by, valid_from, valid_until, days_remaining
+    FROM cert_chain
+    WHERE check_id = ?
+    ORDER BY position`, checkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chain []ChainCert
+	for rows.Next() {
+		var c ChainCert
+		var validFromStr, validUntilStr string
+		err := rows.Scan(&c.Position, &c.IssuedTo, &c.IssuedBy, &validFromStr, &validUntilStr, &c.DaysRemaining)
+		if err != nil {
+			return nil, err
+		}
+		c.ValidFrom, _ = time.Parse(time.RFC3339, validFromStr)
+		c.ValidUntil, _ = time.Parse(time.RFC3339, validUntilStr)
+		chain = append(chain, c)
+	}
+	return chain, rows.Err()
+}
+
+func handleSimpleCerts(w http.ResponseWriter, r *http.Request) {
+	// Ordering by days_remaining to show most urgent first
+	results, err := latestCerts("days_remaining ASC")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	failures, err := currentFailures()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	results = withFailures(results, failures)
+
+	// Any query parameter filters by label, e.g. ?team=payments
+	var filtered []CertInfo
+	for _, info := range results {
+		if matchLabels(info.Labels, r.URL.Query()) {
+			filtered = append(filtered, info)
+		}
+	}
+	results = filtered
 
 	if results == nil {
 		results = []CertInfo{}
@@ -243,37 +577,57 @@ func handleSimpleCerts(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(results)
 }
 
-func checkCertsWorker(cfg Config) {
-	for {
-		for _, url := range cfg.URLs {
-			info, err := getCertInfo(url)
-			if err != nil {
-				log.Printf("Error checking %s: %v", url, err)
-				continue
-			}
-
-			err = storeCertInfo(info)
-			if err != nil {
-				log.Printf("Error storing cert info for %s: %v", url, err)
-			} else {
-				log.Printf("Successfully checked and stored cert info for %s", url)
-			}
+// matchLabels reports whether labels has one of the values filters give
+// for each name.
+func matchLabels(labels map[string]string, filters url.Values) bool {
+	for name, values := range filters {
+		if !slices.Contains(values, labels[name]) {
+			return false
 		}
-		time.Sleep(24 * time.Hour)
 	}
+	return true
 }
 
 func main() {
-	cfg := loadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", defaultConfigPath(), "path to the config file (default $CERTS_CONFIG or ./config.json)")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	applyConfig(cfg)
+	openDB()
+	go watchConfig(*configPath)
+	go discoveryWorker()
 
 	// Start background worker
-	go checkCertsWorker(cfg)
+	go checkCertsWorker()
+	go tlsScanWorker()
+	go retentionWorker()
 
 	// Setup HTTP handlers
-	http.HandleFunc("/metrics", handleMetrics)
+	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/certs/simple", handleSimpleCerts)
+	http.HandleFunc("/certs/check", handleCheck)
+	http.HandleFunc("/certs/history", handleHistory)
+	http.HandleFunc("/certs/annotations", handleAnnotations)
+	http.HandleFunc("/certs/tls", handleTLSInventory)
+	http.HandleFunc("/certs/tls/weak", handleTLSWeak)
+	http.HandleFunc("/certs/calendar.ics", handleCalendar)
+
+	// Grafana JSON datasource
+	http.HandleFunc("/", handleDatasourceRoot)
+	http.HandleFunc("/search", handleSearch)
+	http.HandleFunc("/query", handleQuery)
+	http.HandleFunc("/annotations", handleDatasourceAnnotations)
 
 	log.Println("Starting server on :8080...")
-	log.Println("Background certificate checker running every 1 minute...")
+	log.Printf("Background certificate checker running every %v with %d workers...",
+		time.Duration(cfg.Interval), cfg.Concurrency)
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// useTestDB points db at a fresh, migrated certs.db and cfg as the
+// current config for the duration of the test.
+func useTestDB(t *testing.T, cfg Config) {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "certs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB, prevConfig := db, currentConfig()
+	db = testDB
+	t.Cleanup(func() {
+		testDB.Close()
+		db = prevDB
+		setConfig(prevConfig)
+	})
+
+	if err := migrate(); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+}
+
+func TestLatestCertsDropsRemovedCertificates(t *testing.T) {
+	const url = "file:///etc/ssl/bundle.pem"
+	useTestDB(t, Config{URLs: []Target{{URL: url}}})
+
+	store := func(checkedAt time.Time, indexes ...int) {
+		t.Helper()
+		for _, i := range indexes {
+			info := &CertInfo{
+				URL:         url,
+				Protocol:    ProtocolFile,
+				SourcePath:  "/etc/ssl/bundle.pem",
+				SourceIndex: i,
+				ValidUntil:  checkedAt.AddDate(1, 0, 0),
+				CheckedAt:   checkedAt,
+			}
+			if err := storeCertInfo(info); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	first := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store(first, 0, 1, 2)
+	// A CA removed from the bundle
+	store(first.Add(time.Hour), 0)
+
+	certs, err := latestCerts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []int
+	for _, info := range certs {
+		indexes = append(indexes, info.SourceIndex)
+	}
+	if !slices.Equal(indexes, []int{0}) {
+		t.Errorf("latestCerts returned indexes %v, want [0]", indexes)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// certLabelNames identify a certificate in /metrics. See certLabels.
+var certLabelNames = []string{
+	"url", "host", "ip", "port", "protocol", "source_path", "source_index",
+	"namespace", "name", "kind", "secret_key", "issued_to", "issuer", "discovered_from",
+}
+
+// chainLabelNames identify an intermediate. The leaf's ip and source keep
+// the chains of targets checked per address or read from files apart.
+var chainLabelNames = []string{"url", "ip", "source_path", "source_index", "position", "issued_to", "issuer"}
+
+var (
+	certDaysRemaining = newMetricDesc(
+		"ssl_cert_days_remaining",
+		"Days until the certificate expires",
+		certLabelNames,
+	)
+	certValid = newMetricDesc(
+		"ssl_cert_valid",
+		"Whether the certificate has not expired yet (1 = valid, 0 = expired)",
+		certLabelNames,
+	)
+	certExpiryTimestamp = newMetricDesc(
+		"ssl_cert_expiry_timestamp",
+		"Expiry of the certificate as a Unix timestamp",
+		certLabelNames,
+	)
+	certChainValid = newMetricDesc(
+		"ssl_cert_chain_valid",
+		"Whether the chain verifies against the trusted roots (1 = valid, 0 = broken)",
+		certLabelNames,
+	)
+	certKeySizeBits = newMetricDesc(
+		"ssl_cert_key_size_bits",
+		"Size of the certificate's public key in bits",
+		append(certLabelNames, "key_algorithm"),
+	)
+	certInfo = newMetricDesc(
+		"ssl_cert_info",
+		"Serial, fingerprint and algorithms of the certificate",
+		append(certLabelNames, "serial_number", "fingerprint_sha256", "key_algorithm", "signature_algorithm", "is_ca"),
+	)
+	certHostnameMatch = newMetricDesc(
+		"ssl_cert_hostname_match",
+		"Whether the certificate covers the requested hostname (1 = match, 0 = mismatch)",
+		certLabelNames,
+	)
+	certRevoked = newMetricDesc(
+		"ssl_cert_revoked",
+		"Whether the certificate was revoked (1 = revoked, 0 = good)",
+		certLabelNames,
+	)
+	certConsistent = newMetricDesc(
+		"ssl_cert_consistent",
+		"Whether every address of a target checked with all_addresses serves the same certificate",
+		[]string{"url"},
+	)
+	chainCertDaysRemaining = newMetricDesc(
+		"ssl_chain_cert_days_remaining",
+		"Days until an intermediate certificate expires",
+		chainLabelNames,
+	)
+	chainCertExpiryTimestamp = newMetricDesc(
+		"ssl_chain_cert_expiry_timestamp",
+		"Expiry of an intermediate certificate as a Unix timestamp",
+		chainLabelNames,
+	)
+
+	probeSuccess = newMetricDesc(
+		"ssl_probe_success",
+		"Whether the last check of the target succeeded, with the class of the error if it did not",
+		[]string{"url", "error_class"},
+	)
+	probeDuration = newMetricDesc(
+		"ssl_probe_duration_seconds",
+		"How long the last check of the target took",
+		[]string{"url"},
+	)
+	lastCheckTimestamp = newMetricDesc(
+		"ssl_last_check_timestamp",
+		"Time of the last check of the target as a Unix timestamp",
+		[]string{"url"},
+	)
+	probeFailingSince = newMetricDesc(
+		"ssl_probe_failing_since_timestamp",
+		"First of the failed checks since the target's last successful check as a Unix timestamp",
+		[]string{"url", "ip", "error_class"},
+	)
+	probeConsecutiveFailures = newMetricDesc(
+		"ssl_probe_consecutive_failures",
+		"Number of failed checks since the target's last successful check",
+		[]string{"url", "ip", "error_class"},
+	)
+
+	sweepDuration = prometheus.NewDesc(
+		"ssl_sweep_duration_seconds",
+		"How long the last sweep took",
+		nil, nil,
+	)
+	sweepChecks = prometheus.NewDesc(
+		"ssl_sweep_checks",
+		"Number of checks in the last sweep by result",
+		[]string{"result"}, nil,
+	)
+	sweepLastTimestamp = prometheus.NewDesc(
+		"ssl_sweep_last_timestamp",
+		"Time the last sweep completed as a Unix timestamp",
+		nil, nil,
+	)
+)
+
+// targetMetrics are the metrics whose series are about a target.
+var targetMetrics = []*metricDesc{
+	certDaysRemaining, certValid, certExpiryTimestamp, certChainValid, certKeySizeBits, certInfo,
+	certHostnameMatch, certRevoked, certConsistent, chainCertDaysRemaining, chainCertExpiryTimestamp,
+	probeSuccess, probeDuration, lastCheckTimestamp, probeFailingSince, probeConsecutiveFailures,
+	tlsScanTimestamp, tlsProtocolSupported, tlsCipherSuiteSupported,
+}
+
+// metricDesc describes a metric about targets. Its series also carry the
+// labels set on the targets, whose names are only known once the config
+// is read, so the prometheus.Desc is made on every scrape.
+type metricDesc struct {
+	name, help string
+	labels     []string
+}
+
+func newMetricDesc(name, help string, labels []string) *metricDesc {
+	return &metricDesc{name: name, help: help, labels: labels}
+}
+
+// reservedLabelName reports whether name is set by the metrics themselves,
+// so it can't be used as a target label.
+func reservedLabelName(name string) bool {
+	for _, d := range targetMetrics {
+		if slices.Contains(d.labels, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrape emits the series of one Collect. Every target series carries all
+// target label names, empty where a target doesn't set one, as the series
+// of a metric need the same label names.
+type scrape struct {
+	ch     chan<- prometheus.Metric
+	labels []string // target label names, sorted
+	descs  map[*metricDesc]*prometheus.Desc
+}
+
+func newScrape(ch chan<- prometheus.Metric, labels []string) *scrape {
+	return &scrape{ch: ch, labels: labels, descs: make(map[*metricDesc]*prometheus.Desc)}
+}
+
+func (s *scrape) desc(d *metricDesc) *prometheus.Desc {
+	desc, ok := s.descs[d]
+	if !ok {
+		desc = prometheus.NewDesc(d.name, d.help, append(slices.Clip(d.labels), s.labels...), nil)
+		s.descs[d] = desc
+	}
+	return desc
+}
+
+// gauge emits a series of d with the values of its own labels followed by
+// those of targetLabels.
+func (s *scrape) gauge(d *metricDesc, value float64, targetLabels map[string]string, labels ...string) {
+	values := slices.Clip(labels)
+	for _, name := range s.labels {
+		values = append(values, targetLabels[name])
+	}
+	gauge(s.ch, s.desc(d), value, values...)
+}
+
+func (s *scrape) invalid(d *metricDesc, err error) {
+	s.ch <- prometheus.NewInvalidMetric(s.desc(d), err)
+}
+
+// certCollector reads the latest results from the database on every
+// scrape, so /metrics always reflects what /certs/simple returns.
+type certCollector struct{}
+
+func init() {
+	prometheus.MustRegister(certCollector{})
+}
+
+// Describe sends nothing, which makes certCollector unchecked: the label
+// names of its series depend on the labels of the configured targets.
+func (certCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (certCollector) Collect(ch chan<- prometheus.Metric) {
+	cfg := currentConfig()
+
+	// Latest cert info for each URL
+	certs, err := latestCerts("")
+	if err != nil {
+		newScrape(ch, nil).invalid(certDaysRemaining, err)
+		return
+	}
+	s := newScrape(ch, targetLabelNames(cfg, certs))
+
+	for _, info := range certs {
+		labels := certLabels(info)
+
+		s.gauge(certDaysRemaining, float64(info.DaysRemaining), info.Labels, labels...)
+		s.gauge(certValid, boolValue(info.DaysRemaining > 0), info.Labels, labels...)
+		s.gauge(certExpiryTimestamp, float64(info.ValidUntil.Unix()), info.Labels, labels...)
+
+		// Certificates read from disk have no chain to verify.
+		if info.fromNetwork() {
+			s.gauge(certChainValid, boolValue(info.ChainValid), info.Labels, labels...)
+		}
+
+		// Key size and algorithms, to find weak keys and SHA-1 signatures.
+		// cert-manager Certificates only report their expiry.
+		if info.KeyAlgorithm != "" {
+			s.gauge(certKeySizeBits, float64(info.KeySize), info.Labels, append(labels, info.KeyAlgorithm)...)
+			s.gauge(certInfo, 1, info.Labels, append(labels,
+				info.SerialNumber,
+				info.FingerprintSHA256,
+				info.KeyAlgorithm,
+				info.SignatureAlgorithm,
+				strconv.FormatBool(info.IsCA),
+			)...)
+		}
+
+		if info.HostnameMatch != nil {
+			s.gauge(certHostnameMatch, boolValue(*info.HostnameMatch), info.Labels, labels...)
+		}
+
+		// Only exported when the status could be determined
+		switch info.RevocationStatus {
+		case RevocationRevoked:
+			s.gauge(certRevoked, 1, info.Labels, labels...)
+		case RevocationGood:
+			s.gauge(certRevoked, 0, info.Labels, labels...)
+		}
+
+		// Intermediates expire independently of the leaf
+		for _, c := range info.Chain {
+			chainLabels := []string{
+				info.URL, info.IP, info.SourcePath, strconv.Itoa(info.SourceIndex),
+				strconv.Itoa(c.Position), c.IssuedTo, c.IssuedBy,
+			}
+			s.gauge(chainCertDaysRemaining, float64(c.DaysRemaining), info.Labels, chainLabels...)
+			s.gauge(chainCertExpiryTimestamp, float64(c.ValidUntil.Unix()), info.Labels, chainLabels...)
+		}
+	}
+
+	for url, consistent := range consistentCerts(certs) {
+		target, _ := cfg.findTarget(url)
+		s.gauge(certConsistent, boolValue(consistent), target.Labels, url)
+	}
+
+	// Outcome of the last check of every configured target
+	for _, target := range cfg.URLs {
+		entry, ok := lastCheck(target.URL)
+		if !ok {
+			continue
+		}
+		s.gauge(probeSuccess, boolValue(entry.ErrorClass == ""), target.Labels, target.URL, entry.ErrorClass)
+		s.gauge(probeDuration, entry.Duration.Seconds(), target.Labels, target.URL)
+		s.gauge(lastCheckTimestamp, float64(entry.LastChecked.Unix()), target.Labels, target.URL)
+	}
+
+	// Targets that have been failing since their last successful check,
+	// so they can be told apart from targets that are about to expire.
+	// ip is set when only that address of the target is failing.
+	if failures, err := currentFailures(); err != nil {
+		s.invalid(probeFailingSince, err)
+	} else {
+		for _, f := range failures {
+			target, _ := cfg.findTarget(f.URL)
+			s.gauge(probeFailingSince, float64(f.FailingSince.Unix()), target.Labels, f.URL, f.IP, f.ErrorClass)
+			s.gauge(probeConsecutiveFailures, float64(f.Failures), target.Labels, f.URL, f.IP, f.ErrorClass)
+		}
+	}
+
+	// Protocol and cipher suite inventory
+	if err := collectTLSScanMetrics(s, cfg); err != nil {
+		s.invalid(tlsScanTimestamp, err)
+	}
+
+	// Statistics of the last completed sweep
+	if stats := lastSweepStats(); stats != nil {
+		gauge(ch, sweepDuration, stats.Duration.Seconds())
+		gauge(ch, sweepChecks, float64(stats.Succeeded), "success")
+		gauge(ch, sweepChecks, float64(stats.Failed), "failure")
+		gauge(ch, sweepLastTimestamp, float64(stats.StartedAt.Add(stats.Duration).Unix()))
+	}
+}
+
+// targetLabelNames returns the names of the labels of the configured
+// targets and of the stored certs, which may have been checked with labels
+// since removed from the config.
+func targetLabelNames(cfg Config, certs []CertInfo) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(labels map[string]string) {
+		for name := range labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	for _, t := range cfg.URLs {
+		add(t.Labels)
+	}
+	for _, info := range certs {
+		add(info.Labels)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// certLabels returns the values of certLabelNames for info.
+func certLabels(info CertInfo) []string {
+	return []string{
+		info.URL,
+		info.Host,
+		info.IP,
+		strconv.Itoa(info.Port),
+		info.Protocol,
+		info.SourcePath,
+		strconv.Itoa(info.SourceIndex),
+		info.Namespace,
+		info.Name,
+		info.Kind,
+		info.SecretKey,
+		info.IssuedTo,
+		info.IssuedBy,
+		info.DiscoveredFrom,
+	}
+}
+
+func gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration changes the schema of certs.db from the previous version.
+// Migrations are applied in order, each in its own transaction, and the
+// versions applied are recorded in schema_migrations. New columns and
+// tables get a new migration; released ones are never edited.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "baseline", migrateBaseline},
+	{2, "history indexes", execMigration(`
+    CREATE INDEX IF NOT EXISTS idx_cert_checks_url_checked_at ON cert_checks(url, checked_at);
+    CREATE INDEX IF NOT EXISTS idx_cert_checks_checked_at ON cert_checks(checked_at);
+    CREATE INDEX IF NOT EXISTS idx_check_failures_checked_at ON check_failures(checked_at);`)},
+	{3, "target labels", execMigration(`
+    ALTER TABLE cert_checks ADD COLUMN labels TEXT;`)},
+	{4, "utc timestamps", migrateUTCTimestamps},
+	{5, "address failures and rotations", execMigration(`
+    ALTER TABLE check_failures ADD COLUMN ip TEXT;
+    ALTER TABLE cert_rotations ADD COLUMN ip TEXT;`)},
+	{6, "kubernetes certificate identity", migrateKubeIdentity},
+}
+
+// migrate brings certs.db up to the latest schema version.
+func migrate() error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at DATETIME NOT NULL
+    )`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migrating certs.db to version %d (%s): %v", m.version, m.name, err)
+		}
+		log.Printf("Migrated certs.db to version %d (%s)", m.version, m.name)
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.version, m.name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execMigration returns a migration that runs the statements in query.
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// migrateBaseline creates the schema as it was before migrations were
+// versioned. Databases created by those versions may lack some of its
+// columns, which are added.
+func migrateBaseline(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE IF NOT EXISTS cert_checks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT,
+        host TEXT,
+        port INTEGER,
+        protocol TEXT,
+        source_path TEXT,
+        source_index INTEGER,
+        namespace TEXT,
+        name TEXT,
+        kind TEXT,
+        secret_key TEXT,
+        issued_to TEXT,
+        issued_by TEXT,
+        dns_names TEXT,
+        ip_addresses TEXT,
+        serial_number TEXT,
+        fingerprint_sha256 TEXT,
+        key_algorithm TEXT,
+        key_size INTEGER,
+        signature_algorithm TEXT,
+        is_ca INTEGER,
+        valid_from DATETIME,
+        valid_until DATETIME,
+        days_remaining INTEGER,
+        checked_at DATETIME,
+        chain_valid INTEGER,
+        chain_error TEXT,
+        revocation_status TEXT,
+        revocation_reason TEXT,
+        revocation_source TEXT,
+        revoked_at DATETIME,
+        hostname_match INTEGER,
+        hostname_error TEXT,
+        ip TEXT,
+        client_identity TEXT
+    );
+    CREATE TABLE IF NOT EXISTS cert_chain (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        check_id INTEGER NOT NULL REFERENCES cert_checks(id),
+        position INTEGER,
+        issued_to TEXT,
+        issued_by TEXT,
+        valid_from DATETIME,
+        valid_until DATETIME,
+        days_remaining INTEGER
+    );
+    CREATE INDEX IF NOT EXISTS idx_cert_chain_check_id ON cert_chain(check_id);
+    CREATE TABLE IF NOT EXISTS check_schedule (
+        url TEXT PRIMARY KEY,
+        last_checked DATETIME NOT NULL,
+        days_remaining INTEGER,
+        duration_seconds REAL,
+        error_class TEXT
+    );
+    CREATE TABLE IF NOT EXISTS tls_scans (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        scanned_at DATETIME NOT NULL,
+        error TEXT
+    );
+    CREATE INDEX IF NOT EXISTS idx_tls_scans_url_scanned_at ON tls_scans(url, scanned_at);
+    CREATE TABLE IF NOT EXISTS tls_scan_protocols (
+        scan_id INTEGER NOT NULL REFERENCES tls_scans(id),
+        version TEXT NOT NULL,
+        supported INTEGER NOT NULL,
+        weak INTEGER NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS idx_tls_scan_protocols_scan_id ON tls_scan_protocols(scan_id);
+    CREATE TABLE IF NOT EXISTS tls_scan_ciphers (
+        scan_id INTEGER NOT NULL REFERENCES tls_scans(id),
+        version TEXT NOT NULL,
+        cipher_suite TEXT NOT NULL,
+        weak INTEGER NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS idx_tls_scan_ciphers_scan_id ON tls_scan_ciphers(scan_id);
+    CREATE TABLE IF NOT EXISTS cert_rotations (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        source_path TEXT,
+        source_index INTEGER,
+        rotated_at DATETIME NOT NULL,
+        old_fingerprint_sha256 TEXT,
+        new_fingerprint_sha256 TEXT,
+        old_serial_number TEXT,
+        new_serial_number TEXT,
+        old_issued_by TEXT,
+        new_issued_by TEXT,
+        old_valid_until DATETIME,
+        new_valid_until DATETIME,
+        issuer_changed INTEGER
+    );
+    CREATE INDEX IF NOT EXISTS idx_cert_rotations_url_rotated_at ON cert_rotations(url, rotated_at);
+    CREATE TABLE IF NOT EXISTS check_failures (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        checked_at DATETIME NOT NULL,
+        error_class TEXT NOT NULL,
+        error TEXT
+    );
+    CREATE INDEX IF NOT EXISTS idx_check_failures_url_checked_at ON check_failures(url, checked_at);
+    CREATE TABLE IF NOT EXISTS notifications (
+        url TEXT NOT NULL,
+        source_path TEXT NOT NULL,
+        source_index INTEGER NOT NULL,
+        event TEXT NOT NULL,
+        threshold INTEGER NOT NULL,
+        subject TEXT NOT NULL,
+        sent_at DATETIME NOT NULL,
+        PRIMARY KEY (url, source_path, source_index, event, threshold, subject)
+    );`)
+	if err != nil {
+		return err
+	}
+
+	err = addMissingColumns(tx, "cert_checks", []column{
+		{"chain_valid", "INTEGER"},
+		{"chain_error", "TEXT"},
+		{"host", "TEXT"},
+		{"port", "INTEGER"},
+		{"protocol", "TEXT"},
+		{"source_path", "TEXT"},
+		{"source_index", "INTEGER"},
+		{"namespace", "TEXT"},
+		{"name", "TEXT"},
+		{"kind", "TEXT"},
+		{"secret_key", "TEXT"},
+		{"revocation_status", "TEXT"},
+		{"revocation_reason", "TEXT"},
+		{"revocation_source", "TEXT"},
+		{"revoked_at", "DATETIME"},
+		{"dns_names", "TEXT"},
+		{"ip_addresses", "TEXT"},
+		{"serial_number", "TEXT"},
+		{"fingerprint_sha256", "TEXT"},
+		{"key_algorithm", "TEXT"},
+		{"key_size", "INTEGER"},
+		{"signature_algorithm", "TEXT"},
+		{"is_ca", "INTEGER"},
+		{"hostname_match", "INTEGER"},
+		{"hostname_error", "TEXT"},
+		{"ip", "TEXT"},
+		{"client_identity", "TEXT"},
+	})
+	if err != nil {
+		return err
+	}
+
+	return addMissingColumns(tx, "check_schedule", []column{
+		{"duration_seconds", "REAL"},
+		{"error_class", "TEXT"},
+	})
+}
+
+// timestampColumns are the columns holding RFC 3339 timestamps, by table.
+var timestampColumns = map[string][]string{
+	"cert_checks":    {"valid_from", "valid_until", "checked_at", "revoked_at"},
+	"cert_chain":     {"valid_from", "valid_until"},
+	"check_schedule": {"last_checked"},
+	"tls_scans":      {"scanned_at"},
+	"cert_rotations": {"rotated_at", "old_valid_until", "new_valid_until"},
+	"check_failures": {"checked_at"},
+	"notifications":  {"sent_at"},
+}
+
+// migrateUTCTimestamps rewrites timestamps stored with a local offset in
+// UTC. Time ranges are compared as strings, which only works when every
+// timestamp is written in the same zone.
+func migrateUTCTimestamps(tx *sql.Tx) error {
+	for table, columns := range timestampColumns {
+		for _, c := range columns {
+			_, err := tx.Exec(fmt.Sprintf(`
+    UPDATE %[1]s SET %[2]s = strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', %[2]s)
+    WHERE %[2]s NOT LIKE '%%Z' AND strftime('%%s', %[2]s) IS NOT NULL`, table, c))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateKubeIdentity keys rotations and notifications of Kubernetes
+// certificates by the object and key they were read from, as their
+// position within a manifest shifts when objects are added. The primary
+// key of notifications changes, so the table is rebuilt.
+func migrateKubeIdentity(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+    ALTER TABLE cert_rotations ADD COLUMN namespace TEXT;
+    ALTER TABLE cert_rotations ADD COLUMN name TEXT;
+    ALTER TABLE cert_rotations ADD COLUMN kind TEXT;
+    ALTER TABLE cert_rotations ADD COLUMN secret_key TEXT;
+    CREATE TABLE notifications_new (
+        url TEXT NOT NULL,
+        source_path TEXT NOT NULL,
+        source_index INTEGER NOT NULL,
+        namespace TEXT NOT NULL DEFAULT '',
+        name TEXT NOT NULL DEFAULT '',
+        kind TEXT NOT NULL DEFAULT '',
+        secret_key TEXT NOT NULL DEFAULT '',
+        event TEXT NOT NULL,
+        threshold INTEGER NOT NULL,
+        subject TEXT NOT NULL,
+        sent_at DATETIME NOT NULL,
+        PRIMARY KEY (url, source_path, source_index, namespace, name, kind, secret_key, event, threshold, subject)
+    );
+    INSERT INTO notifications_new (url, source_path, source_index, event, threshold, subject, sent_at)
+    SELECT url, source_path, source_index, event, threshold, subject, sent_at FROM notifications;
+    DROP TABLE notifications;
+    ALTER TABLE notifications_new RENAME TO notifications;`)
+	return err
+}
+
+type column struct {
+	name string
+	def  string
+}
+
+// addMissingColumns adds the columns table doesn't have yet.
+func addMissingColumns(tx *sql.Tx, table string, columns []column) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c.name, c.def)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Notification events.
+const (
+	EventExpiring    = "expiring" // crossed one of the configured thresholds
+	EventExpired     = "expired"
+	EventRevoked     = "revoked"
+	EventUnreachable = "unreachable"
+)
+
+var defaultThresholds = []int{30, 14, 7, 1}
+
+// NotifyConfig sets up notifications sent by the service itself. Each
+// event is sent once per certificate (or, for unreachable targets, once
+// per outage), to the email recipients and every webhook.
+type NotifyConfig struct {
+	// Thresholds are the days remaining at which an expiring certificate
+	// is reported. Only the lowest threshold crossed is sent, so a
+	// certificate first seen with 5 days left doesn't trigger 30 and 14.
+	Thresholds []int        `json:"thresholds,omitempty"`
+	Email      *EmailConfig `json:"email,omitempty"`
+	Webhooks   []string     `json:"webhooks,omitempty"` // receive each Notification as a JSON POST
+}
+
+// EmailConfig uses the same settings as the reporting tool's config.json.
+type EmailConfig struct {
+	EmailFrom    string   `json:"emailFrom"`
+	EmailTo      []string `json:"emailTo"`
+	SMTPHost     string   `json:"smtpHost"`
+	SMTPPort     int      `json:"smtpPort"`
+	SMTPUser     string   `json:"smtpUser"`
+	SMTPPassword string   `json:"smtpPassword"`
+}
+
+func (n *NotifyConfig) applyDefaults() {
+	if len(n.Thresholds) == 0 {
+		n.Thresholds = append([]int(nil), defaultThresholds...)
+	}
+	sort.Ints(n.Thresholds)
+}
+
+// Notification is what is sent for an event.
+type Notification struct {
+	Event         string            `json:"event"`
+	URL           string            `json:"url"`
+	SourcePath    string            `json:"source_path,omitempty"`
+	SourceIndex   int               `json:"source_index"`
+	Namespace     string            `json:"namespace,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	Kind          string            `json:"kind,omitempty"`
+	SecretKey     string            `json:"secret_key,omitempty"`
+	IssuedTo      string            `json:"issued_to,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"` // of the target, for routing
+	ValidUntil    *time.Time        `json:"valid_until,omitempty"`
+	DaysRemaining *int              `json:"days_remaining,omitempty"`
+	Threshold     int               `json:"threshold,omitempty"` // for expiring
+	ErrorClass    string            `json:"error_class,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Message       string            `json:"message"`
+	Time          time.Time         `json:"time"`
+
+	// subject identifies what the event is about, so that it is sent
+	// only once: the certificate fingerprint, or the start of an outage
+	// (and the address it affects).
+	subject string
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyCert sends the events a freshly checked certificate triggers.
+func notifyCert(info *CertInfo) {
+	n := currentConfig().Notifications
+	if n == nil {
+		return
+	}
+
+	base := Notification{
+		URL:           info.URL,
+		SourcePath:    info.SourcePath,
+		SourceIndex:   info.SourceIndex,
+		Namespace:     info.Namespace,
+		Name:          info.Name,
+		Kind:          info.Kind,
+		SecretKey:     info.SecretKey,
+		IssuedTo:      info.IssuedTo,
+		Labels:        info.Labels,
+		ValidUntil:    &info.ValidUntil,
+		DaysRemaining: &info.DaysRemaining,
+		Time:          info.CheckedAt,
+		subject:       info.FingerprintSHA256,
+	}
+	// cert-manager Certificates have no fingerprint
+	if base.subject == "" {
+		base.subject = info.ValidUntil.UTC().Format(time.RFC3339)
+	}
+
+	subject := certSubject(info)
+	if info.ValidUntil.Before(info.CheckedAt) {
+		event := base
+		event.Event = EventExpired
+		event.Message = fmt.Sprintf("Certificate for %s expired on %s", subject, info.ValidUntil.Format("2006-01-02"))
+		notify(n, event)
+	} else {
+		for _, threshold := range n.Thresholds {
+			if info.DaysRemaining > threshold {
+				continue
+			}
+			event := base
+			event.Event = EventExpiring
+			event.Threshold = threshold
+			event.Message = fmt.Sprintf("Certificate for %s expires in %d days (%s)",
+				subject, info.DaysRemaining, info.ValidUntil.Format("2006-01-02"))
+			notify(n, event)
+			break
+		}
+	}
+
+	if info.RevocationStatus == RevocationRevoked {
+		event := base
+		event.Event = EventRevoked
+		event.Message = fmt.Sprintf("Certificate for %s was revoked (%s)", subject, info.RevocationReason)
+		notify(n, event)
+	}
+}
+
+// notifyFailure sends an unreachable event for the outage the failed
+// check f is in.
+func notifyFailure(f *CheckFailure) {
+	n := currentConfig().Notifications
+	if n == nil {
+		return
+	}
+
+	since, err := failingSince(f.URL, f.IP)
+	if err != nil {
+		log.Printf("Error looking up failed checks of %s: %v", f.URL, err)
+		return
+	}
+
+	subject := f.URL
+	outage := since.UTC().Format(time.RFC3339)
+	if f.IP != "" {
+		subject = fmt.Sprintf("%s (%s)", f.URL, f.IP)
+		outage += " " + f.IP
+	}
+
+	target, _ := currentConfig().findTarget(f.URL)
+	notify(n, Notification{
+		Event:      EventUnreachable,
+		URL:        f.URL,
+		Labels:     target.Labels,
+		ErrorClass: f.ErrorClass,
+		Error:      f.Error,
+		Message:    fmt.Sprintf("Certificate check of %s failed: %s", subject, f.Error),
+		Time:       f.CheckedAt,
+		subject:    outage,
+	})
+}
+
+func certSubject(info *CertInfo) string {
+	switch {
+	case info.Kind != "":
+		ref := fmt.Sprintf("%s %s/%s", info.Kind, info.Namespace, info.Name)
+		if info.SecretKey != "" {
+			ref += fmt.Sprintf(" %s #%d", info.SecretKey, info.SourceIndex)
+		}
+		return fmt.Sprintf("%s (%s)", info.URL, ref)
+	case info.SourcePath != "":
+		return fmt.Sprintf("%s (%s #%d)", info.URL, info.SourcePath, info.SourceIndex)
+	case info.IP != "":
+		return fmt.Sprintf("%s (%s)", info.URL, info.IP)
+	}
+	return info.URL
+}
+
+// notify delivers event unless it was sent before. It counts as sent once
+// at least one channel accepted it; otherwise the next check retries.
+func notify(n *NotifyConfig, event Notification) {
+	sent, err := notificationSent(event)
+	if err != nil {
+		log.Printf("Error looking up notifications for %s: %v", event.URL, err)
+		return
+	}
+	if sent {
+		return
+	}
+
+	delivered := false
+	if n.Email != nil {
+		if err := sendNotificationEmail(n.Email, event); err != nil {
+			log.Printf("Error emailing %s notification for %s: %v", event.Event, event.URL, err)
+		} else {
+			delivered = true
+		}
+	}
+	for _, url := range n.Webhooks {
+		if err := postWebhook(url, event); err != nil {
+			log.Printf("Error posting %s notification for %s to %s: %v", event.Event, event.URL, url, err)
+		} else {
+			delivered = true
+		}
+	}
+	if !delivered {
+		return
+	}
+
+	log.Printf("Sent %s notification for %s", event.Event, event.URL)
+	if err := storeNotification(event); err != nil {
+		log.Printf("Error storing %s notification for %s: %v", event.Event, event.URL, err)
+	}
+}
+
+func sendNotificationEmail(cfg *EmailConfig, event Notification) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", cfg.EmailFrom)
+	m.SetHeader("To", cfg.EmailTo...)
+	m.SetHeader("Subject", event.Message)
+
+	body := event.Message + "\n"
+	if event.ValidUntil != nil {
+		body += fmt.Sprintf("\nValid until: %s", event.ValidUntil.Format(time.RFC3339))
+	}
+	if event.IssuedTo != "" {
+		body += fmt.Sprintf("\nIssued to: %s", event.IssuedTo)
+	}
+	if event.ErrorClass != "" {
+		body += fmt.Sprintf("\nError class: %s", event.ErrorClass)
+	}
+	m.SetBody("text/plain", body)
+
+	d := gomail.NewDialer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPassword)
+	return d.DialAndSend(m)
+}
+
+func postWebhook(url string, event Notification) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func notificationSent(event Notification) (bool, error) {
+	var one int
+	err := db.QueryRow(`
+    SELECT 1 FROM notifications
+    WHERE url = ? AND source_path = ? AND source_index = ? AND namespace = ? AND name = ? AND kind = ?
+        AND secret_key = ? AND event = ? AND threshold = ? AND subject = ?`,
+		event.URL, event.SourcePath, event.SourceIndex, event.Namespace, event.Name, event.Kind,
+		event.SecretKey, event.Event, event.Threshold, event.subject,
+	).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func storeNotification(event Notification) error {
+	_, err := db.Exec(`
+    INSERT OR IGNORE INTO notifications (
+        url, source_path, source_index, namespace, name, kind, secret_key, event, threshold, subject, sent_at
+    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.URL, event.SourcePath, event.SourceIndex, event.Namespace, event.Name, event.Kind,
+		event.SecretKey, event.Event, event.Threshold, event.subject,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
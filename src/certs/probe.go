@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Error classes of failed checks, exported as the error_class label of
+// ssl_probe_success.
+const (
+	ErrorClassDNS       = "dns"
+	ErrorClassRefused   = "refused"
+	ErrorClassTimeout   = "timeout"
+	ErrorClassHandshake = "handshake"
+	ErrorClassNoCert    = "no_cert"
+	ErrorClassOther     = "other"
+)
+
+// errNoCertificate is wrapped by checks that succeed without finding a
+// certificate.
+var errNoCertificate = errors.New("no certificate")
+
+// classifyError returns the class of a check error, or "" for nil.
+// Timeouts take precedence, as a handshake that times out is reported as
+// both.
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var hsErr *handshakeError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassRefused
+	case errors.As(err, &hsErr):
+		return ErrorClassHandshake
+	case errors.Is(err, errNoCertificate):
+		return ErrorClassNoCert
+	}
+	return ErrorClassOther
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// retentionInterval is how often old checks are downsampled.
+const retentionInterval = 6 * time.Hour
+
+// retentionWorker periodically thins out history older than
+// Config.RetentionDays to the last check of each certificate per day.
+func retentionWorker() {
+	for {
+		cfg := currentConfig()
+		cutoff := time.Now().AddDate(0, 0, -cfg.RetentionDays)
+
+		start := time.Now()
+		checks, failures, err := downsample(cutoff)
+		if err != nil {
+			log.Printf("Error downsampling history before %s: %v", cutoff.Format("2006-01-02"), err)
+		} else if checks > 0 || failures > 0 {
+			log.Printf("Downsampled history before %s: removed %d checks and %d failed checks in %v",
+				cutoff.Format("2006-01-02"), checks, failures, time.Since(start).Round(time.Millisecond))
+		}
+
+		time.Sleep(retentionInterval)
+	}
+}
+
+// downsample keeps, of the checks before cutoff, only the last one of each
+// certificate (and of the failed checks of each target or address) per
+// UTC day. It returns how many checks and failed checks were removed.
+func downsample(cutoff time.Time) (checks, failures int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	before := cutoff.UTC().Format(time.RFC3339)
+	res, err := tx.Exec(`
+    DELETE FROM cert_checks
+    WHERE checked_at < ? AND id NOT IN (
+        SELECT id FROM (
+            SELECT id,
+                ROW_NUMBER() OVER (
+                    PARTITION BY url, COALESCE(source_path, ''), COALESCE(source_index, 0), COALESCE(ip, ''),
+                        COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, ''),
+                        date(checked_at)
+                    ORDER BY checked_at DESC, id DESC
+                ) as rn
+            FROM cert_checks
+            WHERE checked_at < ?
+        )
+        WHERE rn = 1
+    )`, before, before)
+	if err != nil {
+		return 0, 0, err
+	}
+	if checks, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.Exec("DELETE FROM cert_chain WHERE check_id NOT IN (SELECT id FROM cert_checks)")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err = tx.Exec(`
+    DELETE FROM check_failures
+    WHERE checked_at < ? AND id NOT IN (
+        SELECT id FROM (
+            SELECT id,
+                ROW_NUMBER() OVER (PARTITION BY url, COALESCE(ip, ''), date(checked_at) ORDER BY checked_at DESC, id DESC) as rn
+            FROM check_failures
+            WHERE checked_at < ?
+        )
+        WHERE rn = 1
+    )`, before, before)
+	if err != nil {
+		return 0, 0, err
+	}
+	if failures, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+
+	return checks, failures, tx.Commit()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation statuses recorded for each check.
+const (
+	RevocationGood    = "good"
+	RevocationRevoked = "revoked"
+	RevocationUnknown = "unknown"
+)
+
+// Sources a revocation status can come from.
+const (
+	RevocationSourceStapled = "ocsp-stapled"
+	RevocationSourceOCSP    = "ocsp"
+	RevocationSourceCRL     = "crl"
+)
+
+// maxCRLSize bounds how much of a CRL download is read.
+const maxCRLSize = 32 << 20
+
+var revocationClient = &http.Client{Timeout: 10 * time.Second}
+
+// revocationReasons names the CRLReason codes of RFC 5280.
+var revocationReasons = map[int]string{
+	ocsp.Unspecified:          "unspecified",
+	ocsp.KeyCompromise:        "keyCompromise",
+	ocsp.CACompromise:         "cACompromise",
+	ocsp.AffiliationChanged:   "affiliationChanged",
+	ocsp.Superseded:           "superseded",
+	ocsp.CessationOfOperation: "cessationOfOperation",
+	ocsp.CertificateHold:      "certificateHold",
+	ocsp.RemoveFromCRL:        "removeFromCRL",
+	ocsp.PrivilegeWithdrawn:   "privilegeWithdrawn",
+	ocsp.AACompromise:         "aACompromise",
+}
+
+// Revocation is the revocation state of a certificate. For unknown
+// statuses Reason explains why no answer could be obtained.
+type Revocation struct {
+	Status    string
+	Reason    string
+	RevokedAt time.Time
+	Source    string
+}
+
+type cachedOCSP struct {
+	resp    *ocsp.Response
+	expires time.Time
+}
+
+type cachedCRL struct {
+	list    *x509.RevocationList
+	expires time.Time
+}
+
+var (
+	revocationCacheMu sync.Mutex
+	ocspCache         = make(map[string]cachedOCSP) // keyed by responder URL and serial
+	crlCache          = make(map[string]cachedCRL)  // keyed by distribution point URL
+)
+
+// checkRevocation determines whether cert was revoked by issuer. A stapled
+// OCSP response is used when the server sent one. Otherwise the OCSP
+// responder (ocspURL, or the one named in the certificate) is asked, and
+// the CRL distribution points are the last resort.
+func checkRevocation(cert, issuer *x509.Certificate, stapled []byte, ocspURL string) Revocation {
+	if issuer == nil {
+		return Revocation{Status: RevocationUnknown, Reason: "issuer certificate not available"}
+	}
+
+	var errs []string
+	if len(stapled) > 0 {
+		resp, err := ocsp.ParseResponseForCert(stapled, cert, issuer)
+		if err == nil {
+			return ocspRevocation(resp, RevocationSourceStapled)
+		}
+		errs = append(errs, fmt.Sprintf("stapled ocsp: %v", err))
+	}
+
+	responders := cert.OCSPServer
+	if ocspURL != "" {
+		responders = []string{ocspURL}
+	}
+	for _, url := range responders {
+		resp, err := queryOCSP(url, cert, issuer)
+		if err == nil {
+			return ocspRevocation(resp, RevocationSourceOCSP)
+		}
+		errs = append(errs, fmt.Sprintf("ocsp %s: %v", url, err))
+	}
+
+	for _, url := range cert.CRLDistributionPoints {
+		list, err := fetchCRL(url, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("crl %s: %v", url, err))
+			continue
+		}
+
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return Revocation{
+					Status:    RevocationRevoked,
+					Reason:    revocationReasons[entry.ReasonCode],
+					RevokedAt: entry.RevocationTime,
+					Source:    RevocationSourceCRL,
+				}
+			}
+		}
+		return Revocation{Status: RevocationGood, Source: RevocationSourceCRL}
+	}
+
+	if len(errs) == 0 {
+		return Revocation{Status: RevocationUnknown, Reason: "certificate names no OCSP responder or CRL"}
+	}
+	return Revocation{Status: RevocationUnknown, Reason: strings.Join(errs, "; ")}
+}
+
+func ocspRevocation(resp *ocsp.Response, source string) Revocation {
+	switch resp.Status {
+	case ocsp.Good:
+		return Revocation{Status: RevocationGood, Source: source}
+	case ocsp.Revoked:
+		return Revocation{
+			Status:    RevocationRevoked,
+			Reason:    revocationReasons[resp.RevocationReason],
+			RevokedAt: resp.RevokedAt,
+			Source:    source,
+		}
+	default:
+		return Revocation{Status: RevocationUnknown, Reason: "responder does not know the certificate", Source: source}
+	}
+}
+
+// queryOCSP asks the responder at url about cert, reusing a cached answer
+// until its NextUpdate.
+func queryOCSP(url string, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	key := url + "|" + cert.SerialNumber.String()
+
+	revocationCacheMu.Lock()
+	cached, ok := ocspCache[key]
+	revocationCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.resp, nil
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := revocationClient.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder returned status: %d", httpResp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.NextUpdate.IsZero() {
+		revocationCacheMu.Lock()
+		ocspCache[key] = cachedOCSP{resp: resp, expires: resp.NextUpdate}
+		revocationCacheMu.Unlock()
+	}
+	return resp, nil
+}
+
+// fetchCRL downloads the CRL at url and checks that issuer signed it,
+// reusing a cached copy until its NextUpdate.
+func fetchCRL(url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	revocationCacheMu.Lock()
+	cached, ok := crlCache[url]
+	revocationCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.list, nil
+	}
+
+	resp, err := revocationClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := list.CheckSignatureFrom(issuer); err != nil {
+		return nil, err
+	}
+
+	if !list.NextUpdate.IsZero() {
+		revocationCacheMu.Lock()
+		crlCache[url] = cachedCRL{list: list, expires: list.NextUpdate}
+		revocationCacheMu.Unlock()
+	}
+	return list, nil
+}
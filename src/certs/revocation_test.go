@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues certificates and answers for their revocation status as
+// an OCSP responder and a CRL server would.
+type testCA struct {
+	t         *testing.T
+	cert      *x509.Certificate
+	key       crypto.Signer
+	serial    int64
+	revoked   map[int64]int // serial to CRLReason
+	revokedAt time.Time
+
+	ocspRequests atomic.Int64
+	crlRequests  atomic.Int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		t:         t,
+		cert:      cert,
+		key:       key,
+		serial:    time.Now().UnixNano(), // unique across tests sharing the caches
+		revoked:   make(map[int64]int),
+		revokedAt: time.Now().Add(-time.Hour).Truncate(time.Second),
+	}
+}
+
+// issue returns a leaf certificate naming the given OCSP responder and CRL
+// distribution point, either of which may be empty.
+func (ca *testCA) issue(ocspURL, crlURL string) *x509.Certificate {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 3, 0),
+	}
+	if ocspURL != "" {
+		tmpl.OCSPServer = []string{ocspURL}
+	}
+	if crlURL != "" {
+		tmpl.CRLDistributionPoints = []string{crlURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) revoke(cert *x509.Certificate, reason int) {
+	ca.revoked[cert.SerialNumber.Int64()] = reason
+}
+
+// ocspResponse signs the status of serial, valid for an hour.
+func (ca *testCA) ocspResponse(serial *big.Int) []byte {
+	ca.t.Helper()
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serial,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}
+	if reason, ok := ca.revoked[serial.Int64()]; ok {
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = ca.revokedAt
+		tmpl.RevocationReason = reason
+	}
+	resp, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return resp
+}
+
+// ocspResponder serves POSTed OCSP requests.
+func (ca *testCA) ocspResponder() *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca.ocspRequests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ca.ocspResponse(req.SerialNumber))
+	}))
+	ca.t.Cleanup(srv.Close)
+	return srv
+}
+
+// crlServer serves a CRL of the certificates revoked so far.
+func (ca *testCA) crlServer() *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca.crlRequests.Add(1)
+		var entries []x509.RevocationListEntry
+		for serial, reason := range ca.revoked {
+			entries = append(entries, x509.RevocationListEntry{
+				SerialNumber:   big.NewInt(serial),
+				RevocationTime: ca.revokedAt,
+				ReasonCode:     reason,
+			})
+		}
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                time.Now().Add(-time.Minute),
+			NextUpdate:                time.Now().Add(time.Hour),
+			RevokedCertificateEntries: entries,
+		}, ca.cert, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(crl)
+	}))
+	ca.t.Cleanup(srv.Close)
+	return srv
+}
+
+// unreachableURL returns the URL of a server that has been shut down.
+func unreachableURL() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func TestCheckRevocationOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	responder := ca.ocspResponder()
+
+	good := ca.issue(responder.URL, "")
+	revoked := ca.issue(responder.URL, "")
+	ca.revoke(revoked, ocsp.KeyCompromise)
+	// The certificate names a responder that is down; ocsp_url points at
+	// the local stand-in
+	overridden := ca.issue(unreachableURL(), "")
+	unreachable := ca.issue(unreachableURL(), "")
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		ocspURL string
+		want    Revocation
+	}{
+		{"good", good, "", Revocation{Status: RevocationGood, Source: RevocationSourceOCSP}},
+		{"revoked", revoked, "", Revocation{
+			Status: RevocationRevoked, Reason: "keyCompromise", RevokedAt: ca.revokedAt, Source: RevocationSourceOCSP,
+		}},
+		{"ocsp_url", overridden, responder.URL, Revocation{Status: RevocationGood, Source: RevocationSourceOCSP}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkRevocation(tt.cert, ca.cert, nil, tt.ocspURL)
+			if got.Status != tt.want.Status || got.Reason != tt.want.Reason ||
+				!got.RevokedAt.Equal(tt.want.RevokedAt) || got.Source != tt.want.Source {
+				t.Errorf("checkRevocation = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		got := checkRevocation(unreachable, ca.cert, nil, "")
+		if got.Status != RevocationUnknown || got.Reason == "" {
+			t.Errorf("checkRevocation = %+v, want unknown with the error as reason", got)
+		}
+	})
+
+	t.Run("stapled", func(t *testing.T) {
+		before := ca.ocspRequests.Load()
+		got := checkRevocation(revoked, ca.cert, ca.ocspResponse(revoked.SerialNumber), "")
+		if got.Status != RevocationRevoked || got.Source != RevocationSourceStapled {
+			t.Errorf("checkRevocation = %+v, want revoked from the stapled response", got)
+		}
+		if n := ca.ocspRequests.Load() - before; n != 0 {
+			t.Errorf("responder asked %d times despite the stapled response", n)
+		}
+	})
+
+	t.Run("cached until NextUpdate", func(t *testing.T) {
+		cert := ca.issue(responder.URL, "")
+		before := ca.ocspRequests.Load()
+		for range 3 {
+			if got := checkRevocation(cert, ca.cert, nil, ""); got.Status != RevocationGood {
+				t.Fatalf("checkRevocation = %+v, want good", got)
+			}
+		}
+		if n := ca.ocspRequests.Load() - before; n != 1 {
+			t.Errorf("responder asked %d times, want 1", n)
+		}
+	})
+}
+
+func TestCheckRevocationCRL(t *testing.T) {
+	ca := newTestCA(t)
+	crl := ca.crlServer()
+
+	good := ca.issue("", crl.URL)
+	revoked := ca.issue("", crl.URL)
+	ca.revoke(revoked, ocsp.Superseded)
+	// Falls back to the CRL when the responder is down
+	fallback := ca.issue(unreachableURL(), crl.URL)
+	unreachable := ca.issue("", unreachableURL())
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want Revocation
+	}{
+		{"good", good, Revocation{Status: RevocationGood, Source: RevocationSourceCRL}},
+		{"revoked", revoked, Revocation{
+			Status: RevocationRevoked, Reason: "superseded", RevokedAt: ca.revokedAt, Source: RevocationSourceCRL,
+		}},
+		{"ocsp down", fallback, Revocation{Status: RevocationGood, Source: RevocationSourceCRL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkRevocation(tt.cert, ca.cert, nil, "")
+			if got.Status != tt.want.Status || got.Reason != tt.want.Reason ||
+				!got.RevokedAt.Equal(tt.want.RevokedAt) || got.Source != tt.want.Source {
+				t.Errorf("checkRevocation = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		got := checkRevocation(unreachable, ca.cert, nil, "")
+		if got.Status != RevocationUnknown || got.Reason == "" {
+			t.Errorf("checkRevocation = %+v, want unknown with the error as reason", got)
+		}
+	})
+
+	t.Run("cached until NextUpdate", func(t *testing.T) {
+		// The CRL was fetched by the first check above and not since
+		if n := ca.crlRequests.Load(); n != 1 {
+			t.Errorf("CRL downloaded %d times, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Rotation records a certificate being replaced: a check that returned a
+// different fingerprint than the previous check of the same certificate.
+type Rotation struct {
+	ID             int64     `json:"-"`
+	URL            string    `json:"url"`
+	SourcePath     string    `json:"source_path,omitempty"`
+	SourceIndex    int       `json:"source_index"`
+	IP             string    `json:"ip,omitempty"` // with AllAddresses, the address that rotated
+	Namespace      string    `json:"namespace,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	Kind           string    `json:"kind,omitempty"`
+	SecretKey      string    `json:"secret_key,omitempty"`
+	RotatedAt      time.Time `json:"rotated_at"`
+	OldFingerprint string    `json:"old_fingerprint_sha256"`
+	NewFingerprint string    `json:"new_fingerprint_sha256"`
+	OldSerial      string    `json:"old_serial_number"`
+	NewSerial      string    `json:"new_serial_number"`
+	OldIssuer      string    `json:"old_issued_by"`
+	NewIssuer      string    `json:"new_issued_by"`
+	OldValidUntil  time.Time `json:"old_valid_until"`
+	NewValidUntil  time.Time `json:"new_valid_until"`
+	IssuerChanged  bool      `json:"issuer_changed"`
+}
+
+// detectRotation compares info with the last stored check of the same
+// certificate, which Kubernetes certificates keep by the object and key
+// they were read from. It must run before info is stored. Certificates without a
+// fingerprint (cert-manager Certificates) and first sightings are never
+// reported as rotations.
+func detectRotation(info *CertInfo) (*Rotation, error) {
+	if info.FingerprintSHA256 == "" {
+		return nil, nil
+	}
+
+	var fingerprint, serial, issuer, validUntilStr string
+	err := db.QueryRow(`
+    SELECT fingerprint_sha256, COALESCE(serial_number, ''), issued_by, valid_until
+    FROM cert_checks
+    WHERE url = ? AND COALESCE(source_path, '') = ? AND COALESCE(source_index, 0) = ?
+        AND COALESCE(ip, '') = ? AND COALESCE(namespace, '') = ? AND COALESCE(name, '') = ?
+        AND COALESCE(kind, '') = ? AND COALESCE(secret_key, '') = ? AND COALESCE(fingerprint_sha256, '') != ''
+    ORDER BY checked_at DESC, id DESC
+    LIMIT 1`,
+		info.URL, info.SourcePath, info.SourceIndex, info.IP, info.Namespace, info.Name, info.Kind, info.SecretKey,
+	).Scan(&fingerprint, &serial, &issuer, &validUntilStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fingerprint == info.FingerprintSHA256 {
+		return nil, nil
+	}
+
+	validUntil, _ := time.Parse(time.RFC3339, validUntilStr)
+	return &Rotation{
+		URL:            info.URL,
+		SourcePath:     info.SourcePath,
+		SourceIndex:    info.SourceIndex,
+		IP:             info.IP,
+		Namespace:      info.Namespace,
+		Name:           info.Name,
+		Kind:           info.Kind,
+		SecretKey:      info.SecretKey,
+		RotatedAt:      info.CheckedAt,
+		OldFingerprint: fingerprint,
+		NewFingerprint: info.FingerprintSHA256,
+		OldSerial:      serial,
+		NewSerial:      info.SerialNumber,
+		OldIssuer:      issuer,
+		NewIssuer:      info.IssuedBy,
+		OldValidUntil:  validUntil,
+		NewValidUntil:  info.ValidUntil,
+		IssuerChanged:  issuer != info.IssuedBy,
+	}, nil
+}
+
+func storeRotation(rot *Rotation) error {
+	res, err := db.Exec(`
+    INSERT INTO cert_rotations (
+        url, source_path, source_index, ip, namespace, name, kind, secret_key, rotated_at,
+        old_fingerprint_sha256, new_fingerprint_sha256, old_serial_number, new_serial_number,
+        old_issued_by, new_issued_by, old_valid_until, new_valid_until, issuer_changed
+    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rot.URL,
+		rot.SourcePath,
+		rot.SourceIndex,
+		rot.IP,
+		rot.Namespace,
+		rot.Name,
+		rot.Kind,
+		rot.SecretKey,
+		rot.RotatedAt.UTC().Format(time.RFC3339),
+		rot.OldFingerprint,
+		rot.NewFingerprint,
+		rot.OldSerial,
+		rot.NewSerial,
+		rot.OldIssuer,
+		rot.NewIssuer,
+		rot.OldValidUntil.UTC().Format(time.RFC3339),
+		rot.NewValidUntil.UTC().Format(time.RFC3339),
+		rot.IssuerChanged,
+	)
+	if err != nil {
+		return err
+	}
+
+	rot.ID, err = res.LastInsertId()
+	return err
+}
+
+// loadRotations returns the rotations of url (or of every target when url
+// is empty) between from and to, oldest first.
+func loadRotations(url string, from, to time.Time) ([]Rotation, error) {
+	query := `
+    SELECT id, url, COALESCE(source_path, ''), COALESCE(source_index, 0), COALESCE(ip, ''),
+        COALESCE(namespace, ''), COALESCE(name, ''), COALESCE(kind, ''), COALESCE(secret_key, ''), rotated_at,
+        old_fingerprint_sha256, new_fingerprint_sha256, old_serial_number, new_serial_number,
+        old_issued_by, new_issued_by, old_valid_until, new_valid_until, issuer_changed
+    FROM cert_rotations
+    WHERE rotated_at >= ? AND rotated_at <= ?`
+	args := []interface{}{from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339)}
+	if url != "" {
+		query += " AND url = ?"
+		args = append(args, url)
+	}
+	query += " ORDER BY rotated_at, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotations := []Rotation{}
+	for rows.Next() {
+		var rot Rotation
+		var rotatedAtStr, oldValidUntilStr, newValidUntilStr string
+		err := rows.Scan(
+			&rot.ID,
+			&rot.URL,
+			&rot.SourcePath,
+			&rot.SourceIndex,
+			&rot.IP,
+			&rot.Namespace,
+			&rot.Name,
+			&rot.Kind,
+			&rot.SecretKey,
+			&rotatedAtStr,
+			&rot.OldFingerprint,
+			&rot.NewFingerprint,
+			&rot.OldSerial,
+			&rot.NewSerial,
+			&rot.OldIssuer,
+			&rot.NewIssuer,
+			&oldValidUntilStr,
+			&newValidUntilStr,
+			&rot.IssuerChanged,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rot.RotatedAt, _ = time.Parse(time.RFC3339, rotatedAtStr)
+		rot.OldValidUntil, _ = time.Parse(time.RFC3339, oldValidUntilStr)
+		rot.NewValidUntil, _ = time.Parse(time.RFC3339, newValidUntilStr)
+		rotations = append(rotations, rot)
+	}
+	return rotations, rows.Err()
+}
+
+// handleHistory lists every rotation of ?target, or of all targets.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("target")
+	if url != "" {
+		if _, ok := currentConfig().findTarget(url); !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", url), http.StatusNotFound)
+			return
+		}
+	}
+
+	rotations, err := loadRotations(url, time.Unix(0, 0), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rotations)
+}
+
+// Annotation is an event in the format Grafana's JSON datasources read
+// annotations in.
+type Annotation struct {
+	Time    int64    `json:"time"`              // Unix milliseconds
+	TimeEnd int64    `json:"timeEnd,omitempty"` // set for annotations covering a period
+	Title   string   `json:"title"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+// cert returns the certificate slot rot happened in.
+func (rot Rotation) cert() *CertInfo {
+	return &CertInfo{
+		URL:         rot.URL,
+		SourcePath:  rot.SourcePath,
+		SourceIndex: rot.SourceIndex,
+		IP:          rot.IP,
+		Namespace:   rot.Namespace,
+		Name:        rot.Name,
+		Kind:        rot.Kind,
+		SecretKey:   rot.SecretKey,
+	}
+}
+
+func rotationAnnotation(rot Rotation) Annotation {
+	subject := certSubject(rot.cert())
+
+	text := fmt.Sprintf("Serial %s → %s, expiry %s → %s",
+		rot.OldSerial, rot.NewSerial,
+		rot.OldValidUntil.Format("2006-01-02"), rot.NewValidUntil.Format("2006-01-02"))
+	tags := []string{"rotation", rot.URL}
+	if rot.IssuerChanged {
+		text += fmt.Sprintf(", issuer %s → %s", rot.OldIssuer, rot.NewIssuer)
+		tags = append(tags, "issuer-change")
+	}
+
+	return Annotation{
+		Time:  rot.RotatedAt.UnixMilli(),
+		Title: "Certificate rotated: " + subject,
+		Text:  text,
+		Tags:  tags,
+	}
+}
+
+// handleAnnotations serves rotations and failed checks between ?from and
+// ?to (Unix milliseconds, as Grafana sends them) as annotations, optionally
+// limited to ?target.
+func handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from := time.Unix(0, 0)
+	if fromStr := query.Get("from"); fromStr != "" {
+		fromMs, err := strconv.ParseInt(fromStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'from' parameter", http.StatusBadRequest)
+			return
+		}
+		from = time.UnixMilli(fromMs)
+	}
+
+	to := time.Now()
+	if toStr := query.Get("to"); toStr != "" {
+		toMs, err := strconv.ParseInt(toStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'to' parameter", http.StatusBadRequest)
+			return
+		}
+		to = time.UnixMilli(toMs)
+	}
+
+	rotations, err := loadRotations(query.Get("target"), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outages, err := loadOutages(query.Get("target"), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	annotations := make([]Annotation, 0, len(rotations)+len(outages))
+	for _, rot := range rotations {
+		annotations = append(annotations, rotationAnnotation(rot))
+	}
+	for _, o := range outages {
+		annotations = append(annotations, outageAnnotation(o))
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		return annotations[i].Time < annotations[j].Time
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations)
+}
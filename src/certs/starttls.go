@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Protocols understood by the checker. ProtocolTLS dials TLS directly, the
+// others connect in plain text and upgrade the connection in-band.
+const (
+	ProtocolTLS      = "tls"
+	ProtocolSMTP     = "smtp"
+	ProtocolIMAP     = "imap"
+	ProtocolPOP3     = "pop3"
+	ProtocolLDAP     = "ldap"
+	ProtocolPostgres = "postgres"
+	ProtocolMySQL    = "mysql"
+)
+
+// protocolPorts holds the well-known plain-text port of each protocol,
+// used when a target does not name a port.
+var protocolPorts = map[string]int{
+	ProtocolTLS:      defaultPort,
+	ProtocolSMTP:     25,
+	ProtocolIMAP:     143,
+	ProtocolPOP3:     110,
+	ProtocolLDAP:     389,
+	ProtocolPostgres: 5432,
+	ProtocolMySQL:    3306,
+}
+
+// schemeProtocols maps URL schemes that imply a STARTTLS upgrade.
+var schemeProtocols = map[string]string{
+	"smtp":       ProtocolSMTP,
+	"imap":       ProtocolIMAP,
+	"pop3":       ProtocolPOP3,
+	"ldap":       ProtocolLDAP,
+	"postgres":   ProtocolPostgres,
+	"postgresql": ProtocolPostgres,
+	"mysql":      ProtocolMySQL,
+}
+
+// handshakeError is returned by dialTarget when the connection was
+// established but STARTTLS or the TLS handshake failed.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string { return e.err.Error() }
+func (e *handshakeError) Unwrap() error { return e.err }
+
+// dialTarget connects to target, runs the STARTTLS negotiation for its
+// protocol and completes the TLS handshake. The STARTTLS exchange counts
+// towards the handshake timeout.
+func dialTarget(target Target, cfg *tls.Config) (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(target.DialTimeout)}
+	conn, err := dialer.Dial("tcp", target.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	if target.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(target.HandshakeTimeout)))
+	}
+
+	if err := startTLS(conn, target.Protocol); err != nil {
+		conn.Close()
+		return nil, &handshakeError{fmt.Errorf("%s starttls: %w", target.Protocol, err)}
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &handshakeError{err}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func startTLS(conn net.Conn, protocol string) error {
+	switch protocol {
+	case "", ProtocolTLS:
+		return nil
+	case ProtocolSMTP:
+		return startTLSSMTP(conn)
+	case ProtocolIMAP:
+		return startTLSIMAP(conn)
+	case ProtocolPOP3:
+		return startTLSPOP3(conn)
+	case ProtocolLDAP:
+		return startTLSLDAP(conn)
+	case ProtocolPostgres:
+		return startTLSPostgres(conn)
+	case ProtocolMySQL:
+		return startTLSMySQL(conn)
+	default:
+		return fmt.Errorf("unsupported protocol %q", protocol)
+	}
+}
+
+func startTLSSMTP(conn net.Conn) error {
+	tp := textproto.NewConn(conn)
+
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return err
+	}
+	if err := tp.PrintfLine("EHLO certs-checker"); err != nil {
+		return err
+	}
+	_, msg, err := tp.ReadResponse(250)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(strings.ToUpper(msg), "STARTTLS") {
+		return fmt.Errorf("server does not advertise STARTTLS")
+	}
+	if err := tp.PrintfLine("STARTTLS"); err != nil {
+		return err
+	}
+	_, _, err = tp.ReadResponse(220)
+	return err
+}
+
+func startTLSIMAP(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(greeting))
+	}
+
+	if _, err := io.WriteString(conn, "a001 STARTTLS\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		// Skip untagged responses
+		if !strings.HasPrefix(line, "a001 ") {
+			continue
+		}
+		if !strings.HasPrefix(line, "a001 OK") {
+			return fmt.Errorf("STARTTLS rejected: %s", strings.TrimSpace(line))
+		}
+		return nil
+	}
+}
+
+func startTLSPOP3(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(greeting))
+	}
+
+	if _, err := io.WriteString(conn, "STLS\r\n"); err != nil {
+		return err
+	}
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "+OK") {
+		return fmt.Errorf("STLS rejected: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// ldapStartTLSRequest is an ExtendedRequest (message ID 1) for the
+// StartTLS OID 1.3.6.1.4.1.1466.20037.
+var ldapStartTLSRequest = append(
+	[]byte{0x30, 0x1d, 0x02, 0x01, 0x01, 0x77, 0x18, 0x80, 0x16},
+	"1.3.6.1.4.1.1466.20037"...,
+)
+
+func startTLSLDAP(conn net.Conn) error {
+	if _, err := conn.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+
+	msg, err := readBERElement(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+
+	// LDAPMessage ::= SEQUENCE { messageID, protocolOp, ... }. Servers such
+	// as OpenLDAP use non-minimal length encodings, which encoding/asn1
+	// rejects, so the response is walked by hand.
+	_, message, _, err := parseBER(msg)
+	if err != nil {
+		return err
+	}
+	_, _, rest, err := parseBER(message) // messageID
+	if err != nil {
+		return err
+	}
+	tag, op, _, err := parseBER(rest)
+	if err != nil {
+		return err
+	}
+	// ExtendedResponse is [APPLICATION 24], constructed
+	if tag != 0x78 {
+		return fmt.Errorf("unexpected LDAP response tag 0x%02x", tag)
+	}
+	tag, code, _, err := parseBER(op)
+	if err != nil {
+		return err
+	}
+	if tag != 0x0a || len(code) == 0 {
+		return fmt.Errorf("invalid LDAP result code")
+	}
+
+	resultCode := 0
+	for _, b := range code {
+		resultCode = resultCode<<8 | int(b)
+	}
+	if resultCode != 0 {
+		return fmt.Errorf("StartTLS rejected with LDAP result code %d", resultCode)
+	}
+	return nil
+}
+
+// readBERElement reads one complete BER element (tag, length and contents)
+// from r.
+func readBERElement(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if n := int(header[1] & 0x7f); header[1]&0x80 != 0 {
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("unsupported BER length encoding")
+		}
+		lenBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lenBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lenBytes...)
+	}
+
+	_, length, err := berLength(header[1:])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// parseBER splits the first element of b into its tag and contents and
+// returns whatever follows it.
+func parseBER(b []byte) (tag byte, contents, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+	n, length, err := berLength(b[1:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	start := 1 + n
+	if len(b) < start+length {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+	return b[0], b[start : start+length], b[start+length:], nil
+}
+
+// berLength decodes a definite BER length, returning how many bytes it
+// occupied and its value.
+func berLength(b []byte) (int, int, error) {
+	if b[0]&0x80 == 0 {
+		return 1, int(b[0]), nil
+	}
+	n := int(b[0] & 0x7f)
+	if n == 0 || n > 4 || len(b) < 1+n {
+		return 0, 0, fmt.Errorf("unsupported BER length encoding")
+	}
+	length := 0
+	for _, c := range b[1 : 1+n] {
+		length = length<<8 | int(c)
+	}
+	return 1 + n, length, nil
+}
+
+func startTLSPostgres(conn net.Conn) error {
+	// SSLRequest: length 8 followed by the magic code 80877103
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], 80877103)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 'S' {
+		return fmt.Errorf("server does not support SSL")
+	}
+	return nil
+}
+
+const (
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+)
+
+func startTLSMySQL(conn net.Conn) error {
+	// Initial handshake packet: 3-byte length, sequence id, payload
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return err
+	}
+
+	if len(payload) == 0 || payload[0] == 0xff {
+		return fmt.Errorf("server returned an error instead of a handshake")
+	}
+	if payload[0] != 10 {
+		return fmt.Errorf("unsupported handshake protocol version %d", payload[0])
+	}
+
+	// Skip the server version string, connection id (4), auth data (8) and
+	// filler (1) to reach the lower capability flags.
+	end := strings.IndexByte(string(payload[1:]), 0)
+	if end < 0 {
+		return fmt.Errorf("malformed handshake packet")
+	}
+	pos := 1 + end + 1 + 4 + 8 + 1
+	if len(payload) < pos+2 {
+		return fmt.Errorf("malformed handshake packet")
+	}
+	capabilities := uint32(binary.LittleEndian.Uint16(payload[pos : pos+2]))
+	if capabilities&mysqlClientSSL == 0 {
+		return fmt.Errorf("server does not support SSL")
+	}
+
+	// SSLRequest: capability flags, max packet size, charset, 23 reserved bytes
+	req := make([]byte, 4+32)
+	req[0] = 32
+	req[3] = header[3] + 1
+	binary.LittleEndian.PutUint32(req[4:8], mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection)
+	binary.LittleEndian.PutUint32(req[8:12], 1<<24)
+	req[12] = 33 // utf8_general_ci
+	_, err := conn.Write(req)
+	return err
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPort = 443
+
+// labelNamePattern matches the label names Prometheus accepts.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// defaultPorts maps implicit-TLS URL schemes to the port used when a
+// target URL does not name one explicitly.
+var defaultPorts = map[string]int{
+	"https": 443,
+	"ldaps": 636,
+	"imaps": 993,
+	"pop3s": 995,
+	"smtps": 465,
+}
+
+// Target is a single endpoint to check. In config.json it can be written
+// either as a plain string or as an object carrying per-target options.
+//
+// URL accepts a bare host ("example.com"), a host:port pair
+// ("kafka-1:9093", "[2001:db8::1]:8443"), a bare IPv6 literal or a URL
+// ("https://example.com/path"). Host and Port are filled in by parse.
+//
+// Protocol selects a STARTTLS negotiation (see starttls.go). It defaults to
+// direct TLS, or is inferred from URL schemes such as smtp:// or ldap://.
+//
+// file:// URLs name certificate files on disk instead (see files.go), and
+// k8s:// URLs name exported Kubernetes manifests (see kube.go).
+type Target struct {
+	URL      string `json:"url"`
+	Protocol string `json:"protocol,omitempty"`
+	CABundle string `json:"ca_bundle,omitempty"` // PEM file trusted in addition to the system roots
+	Password string `json:"password,omitempty"`  // for PKCS#12 and JKS files
+	OCSPURL  string `json:"ocsp_url,omitempty"`  // overrides the OCSP responder named in the certificate
+
+	// ClientCert and ClientKey are PEM files presented to servers that
+	// require mutual TLS.
+	ClientCert    string `json:"client_cert,omitempty"`
+	ClientKey     string `json:"client_key,omitempty"`
+	ServerName    string `json:"server_name,omitempty"`     // SNI and expected hostname, if not Host
+	MinTLSVersion string `json:"min_tls_version,omitempty"` // "1.0" to "1.3"
+
+	// Labels are free-form names such as team or env, added to the
+	// target's metrics and stored with its checks.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// AllAddresses checks every address the host resolves to instead of
+	// the one the dialer picks. See addresses.go.
+	AllAddresses bool `json:"all_addresses,omitempty"`
+
+	// Timeouts and schedule for this target; zero means the global value
+	// from Config.
+	DialTimeout      Duration `json:"dial_timeout,omitempty"`
+	HandshakeTimeout Duration `json:"handshake_timeout,omitempty"`
+	Interval         Duration `json:"interval,omitempty"`
+	WarningDays      int      `json:"warning_days,omitempty"`
+	WarningInterval  Duration `json:"warning_interval,omitempty"`
+	TLSScanInterval  Duration `json:"tls_scan_interval,omitempty"`
+
+	Host string `json:"-"`
+	Port int    `json:"-"`
+	Path string `json:"-"` // for file and k8s targets
+	IP   string `json:"-"` // address to dial instead of Host, set per address checked
+
+	// DiscoveredFrom is the discovery source and file the target was read
+	// from, for targets not listed in urls.
+	DiscoveredFrom string `json:"-"`
+
+	MinVersion uint16 `json:"-"` // parsed MinTLSVersion
+}
+
+func (t *Target) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		t.URL = url
+		return nil
+	}
+
+	type plain Target
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+// onDisk reports whether the target reads certificates from disk rather
+// than connecting to an endpoint.
+func (t Target) onDisk() bool {
+	return t.Protocol == ProtocolFile || t.Protocol == ProtocolKubernetes
+}
+
+// inherit fills in options the target leaves unset from the global config.
+func (t *Target) inherit(cfg Config) {
+	if t.DialTimeout <= 0 {
+		t.DialTimeout = cfg.DialTimeout
+	}
+	if t.HandshakeTimeout <= 0 {
+		t.HandshakeTimeout = cfg.HandshakeTimeout
+	}
+	if t.Interval <= 0 {
+		t.Interval = cfg.Interval
+	}
+	if t.WarningDays <= 0 {
+		t.WarningDays = cfg.WarningDays
+	}
+	if t.WarningInterval <= 0 {
+		t.WarningInterval = cfg.WarningInterval
+	}
+	if t.TLSScanInterval <= 0 {
+		t.TLSScanInterval = cfg.TLSScanInterval
+	}
+}
+
+// checkInterval returns how long to wait after a check before checking
+// again. daysRemaining is nil when no certificate has been seen yet.
+func (t Target) checkInterval(daysRemaining *int) time.Duration {
+	interval := time.Duration(t.Interval)
+	if daysRemaining != nil && *daysRemaining <= t.WarningDays {
+		if warning := time.Duration(t.WarningInterval); warning < interval {
+			return warning
+		}
+	}
+	return interval
+}
+
+// serverName returns the name sent as SNI and expected in the
+// certificate.
+func (t Target) serverName() string {
+	if t.ServerName != "" {
+		return t.ServerName
+	}
+	return t.Host
+}
+
+// clientTLSConfig returns the TLS settings shared by every handshake with
+// t: SNI and, for mutual TLS, the client certificate. identity is the
+// subject of that certificate, or empty when none is configured.
+// Verification is left to the caller.
+func (t Target) clientTLSConfig() (cfg *tls.Config, identity string, err error) {
+	cfg = &tls.Config{
+		ServerName:         t.serverName(),
+		InsecureSkipVerify: true,
+	}
+	if t.ClientCert == "" {
+		return cfg, "", nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("loading client certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing client certificate: %v", err)
+	}
+
+	// Present the certificate even if the server's list of acceptable CAs
+	// doesn't name its issuer, which crypto/tls would otherwise refuse.
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &pair, nil
+	}
+	return cfg, leaf.Subject.String(), nil
+}
+
+// Address returns the host:port to dial.
+func (t Target) Address() string {
+	if t.IP != "" {
+		return net.JoinHostPort(t.IP, strconv.Itoa(t.Port))
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// parse splits t.URL into Host and Port, or Path for file targets, and
+// settles the protocol.
+func (t *Target) parse() error {
+	raw := strings.TrimSpace(t.URL)
+	if raw == "" {
+		return fmt.Errorf("empty target")
+	}
+
+	for name := range t.Labels {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid target %q: invalid label name %q", t.URL, name)
+		}
+		if reservedLabelName(name) {
+			return fmt.Errorf("invalid target %q: label %q is already set by the metrics", t.URL, name)
+		}
+	}
+
+	if strings.HasPrefix(raw, filePrefix) {
+		t.Path = strings.TrimPrefix(raw, filePrefix)
+		if t.Path == "" {
+			return fmt.Errorf("invalid target %q: missing path", t.URL)
+		}
+		t.Protocol = ProtocolFile
+		return nil
+	}
+
+	if strings.HasPrefix(raw, kubePrefix) {
+		t.Path = strings.TrimPrefix(raw, kubePrefix)
+		if t.Path == "" {
+			return fmt.Errorf("invalid target %q: missing path", t.URL)
+		}
+		t.Protocol = ProtocolKubernetes
+		return nil
+	}
+
+	var u *url.URL
+	if strings.Contains(raw, "://") {
+		var err error
+		if u, err = url.Parse(raw); err != nil {
+			return fmt.Errorf("invalid target %q: %v", t.URL, err)
+		}
+		if t.Protocol == "" {
+			t.Protocol = schemeProtocols[strings.ToLower(u.Scheme)]
+		}
+	}
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return fmt.Errorf("invalid target %q: client_cert and client_key must be set together", t.URL)
+	}
+	if t.MinTLSVersion != "" {
+		version, ok := parseTLSVersion(t.MinTLSVersion)
+		if !ok {
+			return fmt.Errorf("invalid target %q: unsupported min_tls_version %q", t.URL, t.MinTLSVersion)
+		}
+		t.MinVersion = version
+	}
+
+	t.Protocol = strings.ToLower(t.Protocol)
+	if t.Protocol == "" {
+		t.Protocol = ProtocolTLS
+	}
+	protocolPort, ok := protocolPorts[t.Protocol]
+	if !ok {
+		return fmt.Errorf("invalid target %q: unsupported protocol %q", t.URL, t.Protocol)
+	}
+
+	if u != nil {
+		if u.Hostname() == "" {
+			return fmt.Errorf("invalid target %q: missing host", t.URL)
+		}
+
+		port, ok := defaultPorts[strings.ToLower(u.Scheme)]
+		if !ok {
+			port = protocolPort
+		}
+		if u.Port() != "" {
+			var err error
+			if port, err = parsePort(u.Port()); err != nil {
+				return fmt.Errorf("invalid target %q: %v", t.URL, err)
+			}
+		}
+
+		t.Host, t.Port = u.Hostname(), port
+		return nil
+	}
+
+	// A bare IPv6 literal has colons but no port.
+	if ip := net.ParseIP(strings.Trim(raw, "[]")); ip != nil {
+		t.Host, t.Port = ip.String(), protocolPort
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(raw)
+	if err != nil {
+		// No port given
+		if strings.Contains(raw, ":") {
+			return fmt.Errorf("invalid target %q: %v", t.URL, err)
+		}
+		t.Host, t.Port = raw, protocolPort
+		return nil
+	}
+	if host == "" {
+		return fmt.Errorf("invalid target %q: missing host", t.URL)
+	}
+
+	port, err := parsePort(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %v", t.URL, err)
+	}
+
+	t.Host, t.Port = host, port
+	return nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
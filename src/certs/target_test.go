@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestTargetParse(t *testing.T) {
+	tests := []struct {
+		url      string
+		protocol string // set in config.json, if any
+		host     string
+		port     int
+		want     string // protocol after parsing
+		wantErr  bool
+	}{
+		{url: "example.com", host: "example.com", port: 443, want: ProtocolTLS},
+		{url: " example.com ", host: "example.com", port: 443, want: ProtocolTLS},
+		{url: "kafka-1:9093", host: "kafka-1", port: 9093, want: ProtocolTLS},
+		{url: "https://example.com/health?x=1", host: "example.com", port: 443, want: ProtocolTLS},
+		{url: "https://example.com:8443/", host: "example.com", port: 8443, want: ProtocolTLS},
+		{url: "ldaps://ldap.example.com", host: "ldap.example.com", port: 636, want: ProtocolTLS},
+		{url: "[2001:db8::1]:8443", host: "2001:db8::1", port: 8443, want: ProtocolTLS},
+		{url: "[2001:db8::1]", host: "2001:db8::1", port: 443, want: ProtocolTLS},
+		{url: "2001:db8::1", host: "2001:db8::1", port: 443, want: ProtocolTLS},
+		{url: "https://[2001:db8::1]:8443/", host: "2001:db8::1", port: 8443, want: ProtocolTLS},
+		{url: "smtp://mail.example.com", host: "mail.example.com", port: 25, want: ProtocolSMTP},
+		{url: "smtp://mail.example.com:587", host: "mail.example.com", port: 587, want: ProtocolSMTP},
+		{url: "postgresql://db.example.com", host: "db.example.com", port: 5432, want: ProtocolPostgres},
+		{url: "mail.example.com", protocol: "IMAP", host: "mail.example.com", port: 143, want: ProtocolIMAP},
+
+		{url: "", wantErr: true},
+		{url: "example.com:0", wantErr: true},
+		{url: "example.com:65536", wantErr: true},
+		{url: "example.com:https", wantErr: true},
+		{url: "https://example.com:99999/", wantErr: true},
+		{url: ":443", wantErr: true},
+		{url: "https:///path", wantErr: true},
+		{url: "2001:db8::1:x", wantErr: true},
+		{url: "example.com", protocol: "gopher", wantErr: true},
+	}
+	for _, tt := range tests {
+		target := Target{URL: tt.url, Protocol: tt.protocol}
+		err := target.parse()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parse(%q) = %q, %d, want an error", tt.url, target.Host, target.Port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse(%q): %v", tt.url, err)
+			continue
+		}
+		if target.Host != tt.host || target.Port != tt.port || target.Protocol != tt.want {
+			t.Errorf("parse(%q) = %q, %d, %q, want %q, %d, %q",
+				tt.url, target.Host, target.Port, target.Protocol, tt.host, tt.port, tt.want)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tlsVersions are the protocol versions probed, oldest first. SSLv3 and
+// older can't be negotiated by crypto/tls and aren't probed.
+var tlsVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// TLSScan is the inventory of the protocol versions and cipher suites an
+// endpoint accepts.
+type TLSScan struct {
+	ID           int64            `json:"-"`
+	URL          string           `json:"url"`
+	ScannedAt    time.Time        `json:"scanned_at"`
+	Error        string           `json:"error,omitempty"`
+	Protocols    []TLSProtocol    `json:"protocols"`
+	CipherSuites []TLSCipherSuite `json:"cipher_suites"`
+}
+
+type TLSProtocol struct {
+	Version   string `json:"version"` // "1.0" to "1.3"
+	Supported bool   `json:"supported"`
+	Weak      bool   `json:"weak"`
+}
+
+// TLSCipherSuite is a cipher suite accepted with a given protocol version.
+// TLS 1.3 suites can't be restricted by the client, so only the negotiated
+// one is recorded for it.
+type TLSCipherSuite struct {
+	Version string `json:"version"`
+	Name    string `json:"name"`
+	Weak    bool   `json:"weak"`
+}
+
+// weakProtocol reports whether a protocol version is deprecated (RFC 8996).
+func weakProtocol(version uint16) bool {
+	return version < tls.VersionTLS12
+}
+
+// weakCipherSuites are the suites crypto/tls considers insecure: RC4,
+// 3DES and CBC with SHA-256.
+var weakCipherSuites = func() map[uint16]bool {
+	weak := make(map[uint16]bool)
+	for _, s := range tls.InsecureCipherSuites() {
+		weak[s.ID] = true
+	}
+	return weak
+}()
+
+func versionName(version uint16) string {
+	return strings.TrimPrefix(tls.VersionName(version), "TLS ")
+}
+
+// parseTLSVersion reverses versionName for the probed versions.
+func parseTLSVersion(name string) (uint16, bool) {
+	for _, v := range tlsVersions {
+		if versionName(v) == name {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// cipherSuitesFor returns every suite crypto/tls can offer with version.
+func cipherSuitesFor(version uint16) []*tls.CipherSuite {
+	var suites []*tls.CipherSuite
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		for _, v := range s.SupportedVersions {
+			if v == version {
+				suites = append(suites, s)
+				break
+			}
+		}
+	}
+	return suites
+}
+
+func suiteIDs(suites []*tls.CipherSuite) []uint16 {
+	ids := make([]uint16, len(suites))
+	for i, s := range suites {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+// probeTLS completes a handshake with the settings of base limited to
+// version and, below TLS 1.3, to suites.
+func probeTLS(target Target, base *tls.Config, version uint16, suites []uint16) (tls.ConnectionState, error) {
+	cfg := base.Clone()
+	cfg.MinVersion = version
+	cfg.MaxVersion = version
+	cfg.CipherSuites = suites
+
+	conn, err := dialTarget(target, cfg)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+// scanTLS inventories the protocol versions and cipher suites target
+// accepts, one handshake per combination.
+func scanTLS(target Target) TLSScan {
+	scan := TLSScan{URL: target.URL, ScannedAt: time.Now()}
+
+	base, _, err := target.clientTLSConfig()
+	if err != nil {
+		scan.Error = err.Error()
+		return scan
+	}
+
+	// Make sure the endpoint is reachable at all, so that failed probes
+	// below mean "not accepted" rather than "down".
+	cfg := base.Clone()
+	cfg.MinVersion = tls.VersionTLS10
+	cfg.CipherSuites = suiteIDs(cipherSuitesFor(tls.VersionTLS12))
+	conn, err := dialTarget(target, cfg)
+	if err != nil {
+		scan.Error = err.Error()
+		return scan
+	}
+	conn.Close()
+
+	for _, version := range tlsVersions {
+		suites := cipherSuitesFor(version)
+
+		var offered []uint16
+		if version != tls.VersionTLS13 {
+			offered = suiteIDs(suites)
+		}
+		state, err := probeTLS(target, base, version, offered)
+		supported := err == nil
+
+		scan.Protocols = append(scan.Protocols, TLSProtocol{
+			Version:   versionName(version),
+			Supported: supported,
+			Weak:      weakProtocol(version),
+		})
+		if !supported {
+			continue
+		}
+
+		if version == tls.VersionTLS13 {
+			scan.CipherSuites = append(scan.CipherSuites, TLSCipherSuite{
+				Version: versionName(version),
+				Name:    tls.CipherSuiteName(state.CipherSuite),
+			})
+			continue
+		}
+
+		for _, suite := range suites {
+			if _, err := probeTLS(target, base, version, []uint16{suite.ID}); err != nil {
+				continue
+			}
+			scan.CipherSuites = append(scan.CipherSuites, TLSCipherSuite{
+				Version: versionName(version),
+				Name:    suite.Name,
+				Weak:    weakCipherSuites[suite.ID],
+			})
+		}
+	}
+
+	return scan
+}
+
+func storeTLSScan(scan *TLSScan) error {
+	res, err := db.Exec(
+		"INSERT INTO tls_scans (url, scanned_at, error) VALUES (?, ?, ?)",
+		scan.URL, scan.ScannedAt.UTC().Format(time.RFC3339), scan.Error,
+	)
+	if err != nil {
+		return err
+	}
+
+	scan.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range scan.Protocols {
+		_, err := db.Exec(
+			"INSERT INTO tls_scan_protocols (scan_id, version, supported, weak) VALUES (?, ?, ?, ?)",
+			scan.ID, p.Version, p.Supported, p.Weak,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range scan.CipherSuites {
+		_, err := db.Exec(
+			"INSERT INTO tls_scan_ciphers (scan_id, version, cipher_suite, weak) VALUES (?, ?, ?, ?)",
+			scan.ID, c.Version, c.Name, c.Weak,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestTLSScans returns the most recent scan of each configured URL.
+func latestTLSScans() ([]TLSScan, error) {
+	cfg := currentConfig()
+	rows, err := db.Query(`
+    WITH RankedScans AS (
+        SELECT *,
+            ROW_NUMBER() OVER (PARTITION BY url ORDER BY scanned_at DESC) as rn
+        FROM tls_scans
+    )
+    SELECT id, url, scanned_at, COALESCE(error, '')
+    FROM RankedScans
+    WHERE rn = 1
+    ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scans []TLSScan
+	for rows.Next() {
+		var scan TLSScan
+		var scannedAtStr string
+		if err := rows.Scan(&scan.ID, &scan.URL, &scannedAtStr, &scan.Error); err != nil {
+			return nil, err
+		}
+		if !cfg.hasTarget(scan.URL) {
+			continue
+		}
+		scan.ScannedAt, _ = time.Parse(time.RFC3339, scannedAtStr)
+		scans = append(scans, scan)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range scans {
+		if err := loadTLSScanResults(&scans[i]); err != nil {
+			return nil, err
+		}
+	}
+	return scans, nil
+}
+
+func loadTLSScanResults(scan *TLSScan) error {
+	rows, err := db.Query(
+		"SELECT version, supported, weak FROM tls_scan_protocols WHERE scan_id = ? ORDER BY version", scan.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p TLSProtocol
+		if err := rows.Scan(&p.Version, &p.Supported, &p.Weak); err != nil {
+			rows.Close()
+			return err
+		}
+		scan.Protocols = append(scan.Protocols, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(
+		"SELECT version, cipher_suite, weak FROM tls_scan_ciphers WHERE scan_id = ? ORDER BY version, cipher_suite", scan.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c TLSCipherSuite
+		if err := rows.Scan(&c.Version, &c.Name, &c.Weak); err != nil {
+			return err
+		}
+		scan.CipherSuites = append(scan.CipherSuites, c)
+	}
+	return rows.Err()
+}
+
+// lastTLSScanTimes returns when each URL was last scanned.
+func lastTLSScanTimes() (map[string]time.Time, error) {
+	rows, err := db.Query("SELECT url, MAX(scanned_at) FROM tls_scans GROUP BY url")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	last := make(map[string]time.Time)
+	for rows.Next() {
+		var url, scannedAtStr string
+		if err := rows.Scan(&url, &scannedAtStr); err != nil {
+			return nil, err
+		}
+		last[url], _ = time.Parse(time.RFC3339, scannedAtStr)
+	}
+	return last, rows.Err()
+}
+
+// tlsScanWorker inventories every network target once per its
+// TLSScanInterval. Scan times are read back from the database, so
+// restarts don't trigger a new round of scans.
+func tlsScanWorker() {
+	for {
+		reloaded := configReloaded()
+		cfg := currentConfig()
+
+		last, err := lastTLSScanTimes()
+		if err != nil {
+			log.Printf("Error loading TLS scan times: %v", err)
+			sleepOrReload(maxSchedulerSleep, reloaded)
+			continue
+		}
+
+		now := time.Now()
+		var due []Target
+		for _, target := range cfg.URLs {
+			if target.onDisk() {
+				continue
+			}
+			if !last[target.URL].Add(time.Duration(target.TLSScanInterval)).After(now) {
+				due = append(due, target)
+			}
+		}
+
+		checkPool(due, cfg.Concurrency, time.Duration(*cfg.Jitter), func(target Target) {
+			scan := scanTLS(target)
+			if scan.Error != "" {
+				log.Printf("Error scanning TLS configuration of %s: %s", target.URL, scan.Error)
+			}
+			if err := storeTLSScan(&scan); err != nil {
+				log.Printf("Error storing TLS scan for %s: %v", target.URL, err)
+			}
+		})
+
+		sleepOrReload(maxSchedulerSleep, reloaded)
+	}
+}
+
+var (
+	tlsScanTimestamp = newMetricDesc(
+		"tls_scan_timestamp",
+		"Time of the last TLS scan of the endpoint as a Unix timestamp",
+		[]string{"url"},
+	)
+	tlsProtocolSupported = newMetricDesc(
+		"tls_protocol_supported",
+		"Whether the endpoint accepts the protocol version (1 = accepted, 0 = refused)",
+		[]string{"url", "version"},
+	)
+	tlsCipherSuiteSupported = newMetricDesc(
+		"tls_cipher_suite_supported",
+		"Cipher suites the endpoint accepts with each protocol version",
+		[]string{"url", "version", "cipher_suite", "weak"},
+	)
+)
+
+// collectTLSScanMetrics exports the latest scan of every URL.
+func collectTLSScanMetrics(s *scrape, cfg Config) error {
+	scans, err := latestTLSScans()
+	if err != nil {
+		return err
+	}
+
+	for _, scan := range scans {
+		target, _ := cfg.findTarget(scan.URL)
+		s.gauge(tlsScanTimestamp, float64(scan.ScannedAt.Unix()), target.Labels, scan.URL)
+
+		for _, p := range scan.Protocols {
+			s.gauge(tlsProtocolSupported, boolValue(p.Supported), target.Labels, scan.URL, p.Version)
+		}
+
+		for _, c := range scan.CipherSuites {
+			s.gauge(tlsCipherSuiteSupported, 1, target.Labels, scan.URL, c.Version, c.Name, strconv.FormatBool(c.Weak))
+		}
+	}
+	return nil
+}
+
+func handleTLSInventory(w http.ResponseWriter, r *http.Request) {
+	scans, err := latestTLSScans()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if scans == nil {
+		scans = []TLSScan{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scans)
+}
+
+// WeakTLSConfig lists what a target accepts that it shouldn't.
+type WeakTLSConfig struct {
+	URL          string           `json:"url"`
+	ScannedAt    time.Time        `json:"scanned_at"`
+	Protocols    []string         `json:"weak_protocols"`
+	CipherSuites []TLSCipherSuite `json:"weak_cipher_suites"`
+}
+
+func handleTLSWeak(w http.ResponseWriter, r *http.Request) {
+	scans, err := latestTLSScans()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := []WeakTLSConfig{}
+	for _, scan := range scans {
+		weak := WeakTLSConfig{
+			URL:          scan.URL,
+			ScannedAt:    scan.ScannedAt,
+			Protocols:    []string{},
+			CipherSuites: []TLSCipherSuite{},
+		}
+		for _, p := range scan.Protocols {
+			if p.Supported && p.Weak {
+				weak.Protocols = append(weak.Protocols, p.Version)
+			}
+		}
+		for _, c := range scan.CipherSuites {
+			if c.Weak {
+				weak.CipherSuites = append(weak.CipherSuites, c)
+			}
+		}
+
+		if len(weak.Protocols) > 0 || len(weak.CipherSuites) > 0 {
+			results = append(results, weak)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SweepStats describes the most recent batch of due targets checked
+// together.
+type SweepStats struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Succeeded int
+	Failed    int
+}
+
+var (
+	lastSweepMu sync.Mutex
+	lastSweep   *SweepStats
+)
+
+func lastSweepStats() *SweepStats {
+	lastSweepMu.Lock()
+	defer lastSweepMu.Unlock()
+	return lastSweep
+}
+
+// scheduleEntry is the persisted state the scheduler keeps per target,
+// along with the outcome of its last check.
+type scheduleEntry struct {
+	LastChecked   time.Time
+	DaysRemaining *int
+	Duration      time.Duration
+	ErrorClass    string // empty when the last check succeeded
+}
+
+// maxSchedulerSleep bounds how long the scheduler sleeps between looking
+// for due targets.
+const maxSchedulerSleep = time.Minute
+
+var (
+	scheduleMu sync.Mutex
+	schedule   = make(map[string]scheduleEntry)
+)
+
+// loadSchedule reads the last check time of every target from the
+// database, so a restart only re-checks targets that are actually due.
+func loadSchedule() error {
+	rows, err := db.Query(`
+    SELECT url, last_checked, days_remaining, COALESCE(duration_seconds, 0), COALESCE(error_class, '')
+    FROM check_schedule`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+
+	for rows.Next() {
+		var url, lastCheckedStr string
+		var days sql.NullInt64
+		var duration float64
+		entry := scheduleEntry{}
+		if err := rows.Scan(&url, &lastCheckedStr, &days, &duration, &entry.ErrorClass); err != nil {
+			return err
+		}
+
+		entry.Duration = time.Duration(duration * float64(time.Second))
+		entry.LastChecked, _ = time.Parse(time.RFC3339, lastCheckedStr)
+		if days.Valid {
+			d := int(days.Int64)
+			entry.DaysRemaining = &d
+		}
+		schedule[url] = entry
+	}
+	return rows.Err()
+}
+
+// recordCheck updates the schedule after a check of url that took
+// duration. info is nil when the check failed with checkErr, in which case
+// the last known expiry is kept; it is set along with checkErr when only
+// some addresses failed.
+func recordCheck(url string, checkedAt time.Time, duration time.Duration, info *CertInfo, checkErr error) {
+	scheduleMu.Lock()
+	entry := schedule[url]
+	entry.LastChecked = checkedAt
+	entry.Duration = duration
+	entry.ErrorClass = classifyError(checkErr)
+	if info != nil {
+		days := info.DaysRemaining
+		entry.DaysRemaining = &days
+	}
+	schedule[url] = entry
+	scheduleMu.Unlock()
+
+	_, err := db.Exec(`
+    INSERT INTO check_schedule (url, last_checked, days_remaining, duration_seconds, error_class)
+    VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT(url) DO UPDATE SET
+        last_checked = excluded.last_checked,
+        days_remaining = COALESCE(excluded.days_remaining, check_schedule.days_remaining),
+        duration_seconds = excluded.duration_seconds,
+        error_class = excluded.error_class`,
+		url, checkedAt.UTC().Format(time.RFC3339), entry.DaysRemaining, duration.Seconds(), entry.ErrorClass,
+	)
+	if err != nil {
+		log.Printf("Error storing schedule for %s: %v", url, err)
+	}
+}
+
+// lastCheck returns the schedule entry of url, if it was ever checked.
+func lastCheck(url string) (scheduleEntry, bool) {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	entry, ok := schedule[url]
+	return entry, ok
+}
+
+// nextCheck returns when target is due. Targets that were never checked
+// are due immediately.
+func nextCheck(target Target) time.Time {
+	scheduleMu.Lock()
+	entry, ok := schedule[target.URL]
+	scheduleMu.Unlock()
+
+	if !ok {
+		return time.Time{}
+	}
+	return entry.LastChecked.Add(target.checkInterval(entry.DaysRemaining))
+}
+
+func checkCertsWorker() {
+	if err := loadSchedule(); err != nil {
+		log.Printf("Error loading check schedule, checking all targets now: %v", err)
+	}
+
+	for {
+		reloaded := configReloaded()
+		cfg := currentConfig()
+		now := time.Now()
+		wake := now.Add(maxSchedulerSleep)
+
+		var due []Target
+		for _, target := range cfg.URLs {
+			next := nextCheck(target)
+			if !next.After(now) {
+				due = append(due, target)
+			} else if next.Before(wake) {
+				wake = next
+			}
+		}
+
+		if len(due) > 0 {
+			stats := runSweep(cfg, due)
+			log.Printf("Checked %d targets in %v (%d succeeded, %d failed)",
+				stats.Succeeded+stats.Failed, stats.Duration.Round(time.Millisecond), stats.Succeeded, stats.Failed)
+			continue
+		}
+
+		sleepOrReload(time.Until(wake), reloaded)
+	}
+}
+
+// runSweep checks targets using a pool of cfg.Concurrency workers.
+func runSweep(cfg Config, targets []Target) SweepStats {
+	start := time.Now()
+
+	var succeeded, failed atomic.Int64
+	checkPool(targets, cfg.Concurrency, time.Duration(*cfg.Jitter), func(target Target) {
+		if _, err := checkOnce(target); err != nil {
+			failed.Add(1)
+		} else {
+			succeeded.Add(1)
+		}
+	})
+
+	stats := SweepStats{
+		StartedAt: start,
+		Duration:  time.Since(start),
+		Succeeded: int(succeeded.Load()),
+		Failed:    int(failed.Load()),
+	}
+
+	lastSweepMu.Lock()
+	lastSweep = &stats
+	lastSweepMu.Unlock()
+
+	return stats
+}
+
+// checkPool calls fn for every target from concurrency workers, waiting a
+// random delay of up to jitter before each call.
+func checkPool(targets []Target, concurrency int, jitter time.Duration, fn func(Target)) {
+	jobs := make(chan Target)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				if jitter > 0 {
+					time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
+				}
+				fn(target)
+			}
+		}()
+	}
+
+	for _, target := range targets {
+		jobs <- target
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// inflightCheck is a check that is currently running, shared by every
+// caller asking for the same target in the meantime.
+type inflightCheck struct {
+	done  chan struct{}
+	infos []*CertInfo
+	err   error
+}
+
+var (
+	inflightMu sync.Mutex
+	inflight   = make(map[string]*inflightCheck)
+)
+
+// checkOnce checks target unless a check of it is already running, in
+// which case it waits for that check and returns its result.
+func checkOnce(target Target) ([]*CertInfo, error) {
+	inflightMu.Lock()
+	if c, ok := inflight[target.URL]; ok {
+		inflightMu.Unlock()
+		<-c.done
+		return c.infos, c.err
+	}
+	c := &inflightCheck{done: make(chan struct{})}
+	inflight[target.URL] = c
+	inflightMu.Unlock()
+
+	c.infos, c.err = checkTarget(target)
+
+	inflightMu.Lock()
+	delete(inflight, target.URL)
+	inflightMu.Unlock()
+	close(c.done)
+
+	return c.infos, c.err
+}
+
+// checkTarget checks a single target and stores the result. Network
+// targets yield one certificate (or one per address with AllAddresses),
+// targets on disk one per certificate found. When only some addresses
+// failed, their certificates are returned along with the error.
+func checkTarget(target Target) ([]*CertInfo, error) {
+	start := time.Now()
+	infos, err := getCertInfos(target)
+	duration := time.Since(start)
+	if len(infos) == 0 {
+		checkedAt := time.Now()
+		recordCheck(target.URL, checkedAt, duration, nil, err)
+		recordFailures(target.URL, checkedAt, err)
+		log.Printf("Error checking %s: %v", target.URL, err)
+		return nil, err
+	}
+	recordCheck(target.URL, infos[0].CheckedAt, duration, soonestExpiry(infos), err)
+	if err != nil {
+		// Some addresses failed: the others are stored below
+		recordFailures(target.URL, infos[0].CheckedAt, err)
+		log.Printf("Error checking %s: %v", target.URL, err)
+	}
+
+	for _, info := range infos {
+		if info.fromNetwork() && !info.ChainValid {
+			log.Printf("Certificate chain for %s does not verify: %s", target.URL, info.ChainError)
+		}
+		if info.HostnameMatch != nil && !*info.HostnameMatch {
+			log.Printf("Certificate for %s does not match the hostname: %s", target.URL, info.HostnameError)
+		}
+		if info.RevocationStatus == RevocationRevoked {
+			log.Printf("Certificate for %s was revoked (%s)", target.URL, info.RevocationReason)
+		}
+
+		rot, err := detectRotation(info)
+		if err != nil {
+			log.Printf("Error looking up previous check of %s: %v", target.URL, err)
+		} else if rot != nil {
+			log.Printf("Certificate for %s was rotated (serial %s -> %s)", target.URL, rot.OldSerial, rot.NewSerial)
+			if rot.IssuerChanged {
+				log.Printf("Issuer of %s changed from %q to %q", target.URL, rot.OldIssuer, rot.NewIssuer)
+			}
+			if err := storeRotation(rot); err != nil {
+				log.Printf("Error storing rotation for %s: %v", target.URL, err)
+			}
+		}
+
+		err = storeCertInfo(info)
+		if err != nil {
+			log.Printf("Error storing cert info for %s: %v", target.URL, err)
+			return nil, err
+		}
+
+		notifyCert(info)
+	}
+
+	if err == nil {
+		log.Printf("Successfully checked and stored cert info for %s", target.URL)
+	}
+	return infos, err
+}
+
+// getCertInfos checks target without storing the result. With
+// AllAddresses, the certificates of the addresses that answered are
+// returned even when others failed, along with their addressErrors.
+func getCertInfos(target Target) ([]*CertInfo, error) {
+	var infos []*CertInfo
+	var err error
+	switch {
+	case target.Protocol == ProtocolFile:
+		infos, err = getFileCertInfos(target)
+	case target.Protocol == ProtocolKubernetes:
+		infos, err = getKubeCertInfos(target)
+	case target.AllAddresses:
+		infos, err = getAddressCertInfos(target)
+	default:
+		var info *CertInfo
+		info, err = getCertInfo(target)
+		if info != nil {
+			infos = []*CertInfo{info}
+		}
+	}
+	if len(infos) == 0 {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		info.Labels = target.Labels
+	}
+	return infos, err
+}
+
+// soonestExpiry returns the certificate that expires first.
+func soonestExpiry(infos []*CertInfo) *CertInfo {
+	soonest := infos[0]
+	for _, info := range infos[1:] {
+		if info.ValidUntil.Before(soonest.ValidUntil) {
+			soonest = info
+		}
+	}
+	return soonest
+}
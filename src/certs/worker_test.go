@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetCertInfosUnreachable(t *testing.T) {
+	// Reserve a port, then close it so nothing listens there
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var cfg Config
+	cfg.applyDefaults()
+	target := Target{URL: addr}
+	if err := target.parse(); err != nil {
+		t.Fatal(err)
+	}
+	target.inherit(cfg)
+
+	infos, err := getCertInfos(target)
+	if err == nil {
+		t.Fatalf("getCertInfos(%q) succeeded, want an error", addr)
+	}
+	if infos != nil {
+		t.Errorf("getCertInfos(%q) = %v, want no certificates", addr, infos)
+	}
+	if class := classifyError(err); class != ErrorClassRefused {
+		t.Errorf("error class = %q, want %q (%v)", class, ErrorClassRefused, err)
+	}
+}